@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	_ "image/gif"
+
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// AssetPipeline prepares images for Typst before compilation. It converts
+// formats Typst can't embed to PNG, applies EXIF orientation and
+// downsamples images whose resolution exceeds DPI for the size they take
+// up on the page. Results are cached in CacheDir by content hash.
+type AssetPipeline struct {
+	CacheDir string
+	DPI      int
+}
+
+// Process returns the path of a version of the image at path that Typst
+// can embed, or path itself when the image needs no processing. width and
+// height are the size the image takes up on the page in inches; either
+// may be zero when unknown.
+func (p *AssetPipeline) Process(path string, width, height float64) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		// Not a raster image we know, such as SVG. Leave it to Typst.
+		return path, nil
+	}
+
+	orientation := 1
+	if format == "jpeg" {
+		orientation = exifOrientation(data)
+	}
+	pixelWidth, pixelHeight := config.Width, config.Height
+	if orientation >= 5 {
+		pixelWidth, pixelHeight = pixelHeight, pixelWidth
+	}
+
+	maxWidth := 0
+	if p.DPI > 0 {
+		switch {
+		case width > 0:
+			maxWidth = int(width * float64(p.DPI))
+		case height > 0 && pixelHeight > 0:
+			maxWidth = int(height * float64(p.DPI) * float64(pixelWidth) / float64(pixelHeight))
+		}
+	}
+	downsample := maxWidth > 0 && pixelWidth > maxWidth
+
+	supported := format == "png" || format == "jpeg" || format == "gif"
+	if supported && orientation == 1 && !downsample {
+		return path, nil
+	}
+
+	ext := ".png"
+	if format == "jpeg" {
+		ext = ".jpg"
+	}
+	hash := sha256.New()
+	_, _ = hash.Write(data)
+	if downsample {
+		_, _ = hash.Write([]byte(strconv.Itoa(maxWidth)))
+	}
+	cached := filepath.Join(p.CacheDir, hex.EncodeToString(hash.Sum(nil))+ext)
+	if _, err := os.Stat(cached); err == nil {
+		return cached, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	img = orient(img, orientation)
+	if downsample {
+		b := img.Bounds()
+		dst := image.NewNRGBA(image.Rect(0, 0, maxWidth, max(1, b.Dy()*maxWidth/b.Dx())))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+		img = dst
+	}
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	err = cacheWrite(cached, buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+	return cached, nil
+}
+
+// Store writes data to the cache and returns its path, which is named by
+// a hash of data and ends with ext.
+func (p *AssetPipeline) Store(data []byte, ext string) (string, error) {
+	sum := sha256.Sum256(data)
+	cached := filepath.Join(p.CacheDir, hex.EncodeToString(sum[:])+ext)
+	if _, err := os.Stat(cached); err == nil {
+		return cached, nil
+	}
+	err := cacheWrite(cached, data)
+	if err != nil {
+		return "", err
+	}
+	return cached, nil
+}
+
+// cacheWrite atomically writes data to path in a cache, so an interrupted
+// build never leaves a truncated file behind to be reused.
+func cacheWrite(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "*"+filepath.Ext(path))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// decodeDataURI decodes a data URI such as data:image/png;base64,iVBO...
+// into its media type and data.
+func decodeDataURI(uri []byte) (string, []byte, error) {
+	header, payload, ok := bytes.Cut(bytes.TrimPrefix(uri, []byte("data:")), []byte(","))
+	if !ok {
+		return "", nil, errors.New("invalid data URI: missing comma")
+	}
+	params := strings.Split(string(header), ";")
+	mediaType := strings.ToLower(params[0])
+	if mediaType == "" {
+		mediaType = "text/plain"
+	}
+
+	if params[len(params)-1] == "base64" {
+		data, err := base64.StdEncoding.DecodeString(string(payload))
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid data URI: %w", err)
+		}
+		return mediaType, data, nil
+	}
+	data, err := url.PathUnescape(string(payload))
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid data URI: %w", err)
+	}
+	return mediaType, []byte(data), nil
+}
+
+// imageFormats maps image media types to Typst image formats.
+var imageFormats = map[string]string{
+	"image/png":     "png",
+	"image/jpeg":    "jpg",
+	"image/gif":     "gif",
+	"image/svg+xml": "svg",
+	"image/webp":    "webp",
+	"image/bmp":     "bmp",
+	"image/tiff":    "tiff",
+}
+
+// mediaTypeExtension returns the file extension for an image media type.
+func mediaTypeExtension(mediaType string) string {
+	if format, ok := imageFormats[mediaType]; ok {
+		return "." + format
+	}
+	return ""
+}
+
+// exifOrientation returns the EXIF orientation of JPEG data, from 1 to 8,
+// or 1 if it has none.
+func exifOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xDA || i+2+size > len(data) {
+			return 1 // Start of scan, metadata is over.
+		}
+		segment := data[i+4 : i+2+size]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// orient transforms img so that it displays upright given its EXIF
+// orientation.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	var dst *image.NRGBA
+	if orientation >= 5 {
+		dst = image.NewNRGBA(image.Rect(0, 0, h, w))
+	} else {
+		dst = image.NewNRGBA(image.Rect(0, 0, w, h))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // Mirrored horizontally.
+				dx, dy = w-1-x, y
+			case 3: // Rotated 180°.
+				dx, dy = w-1-x, h-1-y
+			case 4: // Mirrored vertically.
+				dx, dy = x, h-1-y
+			case 5: // Mirrored along the top-left diagonal.
+				dx, dy = y, x
+			case 6: // Rotated 90° clockwise.
+				dx, dy = h-1-y, x
+			case 7: // Mirrored along the top-right diagonal.
+				dx, dy = h-1-y, w-1-x
+			case 8: // Rotated 90° counterclockwise.
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// textWidth is the width of the text area set in template.typ in inches:
+// A4 paper without the left and right margins, 21cm - 3cm - 1cm.
+const textWidth = 17 / 2.54
+
+// fontSize is the text size set in template.typ in inches.
+const fontSize = 14.0 / 72
+
+// lengthInches converts a length accepted by typstLength to inches.
+// Percentages are relative to the text width.
+func lengthInches(s string) (float64, error) {
+	m := lengthPattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid length %q", s)
+	}
+	f, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	switch m[2] {
+	case "", "px":
+		return f / 96, nil
+	case "pt":
+		return f / 72, nil
+	case "mm":
+		return f / 25.4, nil
+	case "cm":
+		return f / 2.54, nil
+	case "in":
+		return f, nil
+	case "em":
+		return f * fontSize, nil
+	case "%":
+		return f / 100 * textWidth, nil
+	default:
+		return 0, fmt.Errorf("invalid length %q", s)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed gost-r-7.0.5-2008.csl
+var gostStyleBytes []byte
+
+// GOSTStyleFile returns the path of the bundled GOST R 7.0.5-2008 citation
+// style, which Russian universities require. It is written to cacheDir so
+// that Typst can read it.
+func GOSTStyleFile(cacheDir string) (string, error) {
+	sum := sha256.Sum256(gostStyleBytes)
+	cached := filepath.Join(cacheDir, hex.EncodeToString(sum[:])+".csl")
+	if _, err := os.Stat(cached); err == nil {
+		return cached, nil
+	}
+	err := cacheWrite(cached, gostStyleBytes)
+	if err != nil {
+		return "", err
+	}
+	return cached, nil
+}
+
+// bibtexEntryPattern matches the start of a BibTeX entry up to its key.
+var bibtexEntryPattern = regexp.MustCompile(`@([A-Za-z]+)\s*[{(]\s*([^,\s{}()]+)\s*,`)
+
+// ReadBibliographyKeys returns the keys of the entries of a BibTeX file,
+// with a .bib extension, or of a Hayagriva file, with a .yml or .yaml
+// extension.
+func ReadBibliographyKeys(path string) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]bool)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".bib":
+		for _, m := range bibtexEntryPattern.FindAllSubmatch(data, -1) {
+			switch strings.ToLower(string(m[1])) {
+			case "comment", "preamble", "string":
+				continue
+			}
+			keys[string(m[2])] = true
+		}
+	case ".yml", ".yaml":
+		var entries map[string]yaml.Node
+		err := yaml.Unmarshal(data, &entries)
+		if err != nil {
+			return nil, err
+		}
+		for key := range entries {
+			keys[key] = true
+		}
+	default:
+		return nil, fmt.Errorf("want a .bib, .yml or .yaml file")
+	}
+	return keys, nil
+}
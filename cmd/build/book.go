@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
+	"gopkg.in/yaml.v3"
+)
+
+// Book is a document assembled from chapter files listed in a manifest.
+// Chapter paths are relative to the manifest.
+type Book struct {
+	Parts []BookPart
+}
+
+// BookPart is a titled part of a book, or its appendices. The chapters
+// before the first part are in a part without a title.
+type BookPart struct {
+	Title      string
+	Appendices bool
+	Chapters   []BookChapter
+}
+
+// BookChapter is a chapter file of a book. Level is the nesting level of
+// the chapter in the manifest, which its headings are shifted by, and
+// Line is its line in the manifest, or 0 if unknown.
+type BookChapter struct {
+	File  string
+	Level int
+	Line  int
+}
+
+// isManifest reports whether path names a book manifest rather than a
+// Markdown document.
+func isManifest(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return true
+	default:
+		return filepath.Base(path) == "SUMMARY.md"
+	}
+}
+
+// ReadBook reads a book manifest, either a SUMMARY.md or a YAML file.
+//
+// A SUMMARY.md lists chapters as links, as mdBook does. Nested list items
+// are subchapters. A level 1 heading at the very start is the title of
+// the summary and is ignored; later ones start parts, and a part titled
+// Appendices or Приложения holds the appendices.
+//
+// A YAML manifest lists the chapters before the first part, the parts
+// and the appendices:
+//
+//	chapters: [introduction.md]
+//	parts:
+//	  - title: Theory
+//	    chapters: [models.md, methods.md]
+//	appendices: [data.md]
+func ReadBook(path string) (*Book, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	parse := parseBookYAML
+	if filepath.Ext(path) == ".md" {
+		parse = parseSummary
+	}
+	b, err := parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return b, nil
+}
+
+func parseBookYAML(data []byte) (*Book, error) {
+	var manifest struct {
+		Chapters []string `yaml:"chapters"`
+		Parts    []struct {
+			Title    string   `yaml:"title"`
+			Chapters []string `yaml:"chapters"`
+		} `yaml:"parts"`
+		Appendices []string `yaml:"appendices"`
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(&manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	chapters := func(files []string) []BookChapter {
+		chapters := make([]BookChapter, 0, len(files))
+		for _, f := range files {
+			chapters = append(chapters, BookChapter{File: f})
+		}
+		return chapters
+	}
+	b := &Book{}
+	if len(manifest.Chapters) != 0 {
+		b.Parts = append(b.Parts, BookPart{Chapters: chapters(manifest.Chapters)})
+	}
+	for _, p := range manifest.Parts {
+		b.Parts = append(b.Parts, BookPart{Title: p.Title, Chapters: chapters(p.Chapters)})
+	}
+	if len(manifest.Appendices) != 0 {
+		b.Parts = append(b.Parts, BookPart{Appendices: true, Chapters: chapters(manifest.Appendices)})
+	}
+	if len(b.Parts) == 0 {
+		return nil, fmt.Errorf("no chapters")
+	}
+	return b, nil
+}
+
+func parseSummary(data []byte) (*Book, error) {
+	doc := goldmark.New().Parser().Parse(text.NewReader(data))
+	b := &Book{Parts: []BookPart{{}}}
+
+	var addLinks func(n ast.Node, level int)
+	addLinks = func(n ast.Node, level int) {
+		for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+			switch c := c.(type) {
+			case *ast.Link:
+				if len(c.Destination) == 0 {
+					continue // A draft chapter.
+				}
+				part := &b.Parts[len(b.Parts)-1]
+				part.Chapters = append(part.Chapters, BookChapter{File: string(c.Destination), Level: level, Line: lineNumber(c, data)})
+			case *ast.List:
+				for item := c.FirstChild(); item != nil; item = item.NextSibling() {
+					addLinks(item, level+1)
+				}
+			case *ast.Paragraph, *ast.TextBlock:
+				addLinks(c, level)
+			}
+		}
+	}
+
+	for n := doc.FirstChild(); n != nil; n = n.NextSibling() {
+		switch n := n.(type) {
+		case *ast.Heading:
+			if n.Level != 1 {
+				continue
+			}
+			if n == doc.FirstChild() {
+				continue // The title of the summary.
+			}
+			title := string(plainText(n, data))
+			if strings.EqualFold(title, "Appendices") || strings.EqualFold(title, "Приложения") {
+				b.Parts = append(b.Parts, BookPart{Appendices: true})
+			} else {
+				b.Parts = append(b.Parts, BookPart{Title: title})
+			}
+		case *ast.List:
+			for item := n.FirstChild(); item != nil; item = item.NextSibling() {
+				addLinks(item, 0)
+			}
+		case *ast.Paragraph:
+			addLinks(n, 0)
+		}
+	}
+	if len(b.Parts[0].Chapters) == 0 {
+		b.Parts = b.Parts[1:]
+	}
+	if len(b.Parts) == 0 {
+		return nil, fmt.Errorf("no chapters")
+	}
+	return b, nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/goldmark/util"
+	"gopkg.in/yaml.v3"
+)
+
+// Chart is a bar or line chart drawn with Typst primitives. It is parsed
+// from the body of a chart fence: an optional YAML header with the chart
+// options, a --- line and CSV data whose first column holds the
+// categories and whose other columns hold the series. Without the ---
+// line, the body is either CSV or YAML with the data in categories and
+// series.
+type Chart struct {
+	Type       string        `yaml:"type"`
+	Width      string        `yaml:"width"`
+	Height     string        `yaml:"height"`
+	XLabel     string        `yaml:"x-label"`
+	YLabel     string        `yaml:"y-label"`
+	Categories []string      `yaml:"categories"`
+	Series     []ChartSeries `yaml:"series"`
+}
+
+type ChartSeries struct {
+	Name   string    `yaml:"name"`
+	Values []float64 `yaml:"values"`
+}
+
+// parseChart parses the body of a chart fence without validating the
+// chart, leaving the type empty unless the body sets it.
+func parseChart(body []byte) (*Chart, error) {
+	c := &Chart{Width: "100%", Height: "8cm"}
+
+	header, data, ok := cutChartSeparator(body)
+	if !ok {
+		var m map[string]any
+		if yaml.Unmarshal(body, &m) == nil && m != nil {
+			header, data = body, nil
+		} else {
+			header, data = nil, body
+		}
+	}
+
+	if len(header) > 0 {
+		decoder := yaml.NewDecoder(bytes.NewReader(header))
+		decoder.KnownFields(true)
+		err := decoder.Decode(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(data) > 0 {
+		err := c.parseCSV(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// validate checks a parsed chart and defaults its type to bar.
+func (c *Chart) validate() error {
+	if c.Type == "" {
+		c.Type = "bar"
+	}
+	if c.Type != "bar" && c.Type != "line" {
+		return fmt.Errorf("unknown chart type %q, want bar or line", c.Type)
+	}
+	if len(c.Categories) == 0 || len(c.Series) == 0 {
+		return errors.New("empty chart")
+	}
+	for _, s := range c.Series {
+		if len(s.Values) != len(c.Categories) {
+			return fmt.Errorf("series %q has %d values for %d categories", s.Name, len(s.Values), len(c.Categories))
+		}
+		for _, v := range s.Values {
+			if math.IsInf(v, 0) || math.IsNaN(v) {
+				return fmt.Errorf("series %q has non-finite value %v", s.Name, v)
+			}
+		}
+	}
+	return nil
+}
+
+func cutChartSeparator(body []byte) (header, data []byte, ok bool) {
+	if bytes.HasPrefix(body, []byte("---\n")) {
+		return nil, body[4:], true
+	}
+	return bytes.Cut(body, []byte("\n---\n"))
+}
+
+func (c *Chart) parseCSV(data []byte) error {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(records) < 2 || len(records[0]) < 2 {
+		return errors.New("chart data needs a header row and a value column")
+	}
+
+	c.Categories = nil
+	c.Series = make([]ChartSeries, len(records[0])-1)
+	for j := range c.Series {
+		c.Series[j].Name = records[0][j+1]
+	}
+	for _, record := range records[1:] {
+		c.Categories = append(c.Categories, record[0])
+		for j := range c.Series {
+			v, err := strconv.ParseFloat(strings.TrimSpace(record[j+1]), 64)
+			if err != nil {
+				return fmt.Errorf("chart data: %w", err)
+			}
+			if math.IsInf(v, 0) || math.IsNaN(v) {
+				return fmt.Errorf("chart data: non-finite value %q", record[j+1])
+			}
+			c.Series[j].Values = append(c.Series[j].Values, v)
+		}
+	}
+	return nil
+}
+
+// Chart layout in centimeters.
+const (
+	chartMargin     = 0.3
+	chartTickLabel  = 1.5
+	chartAxisLabel  = 0.7
+	chartCategory   = 0.9
+	chartLegend     = 0.7
+	chartMarker     = 0.08
+	chartBarPadding = 0.1
+)
+
+// write writes the chart as a Typst box of placed shapes. Colors and the
+// text size come from the papermark-chart variables of template.typ.
+func (c *Chart) write(w util.BufWriter) error {
+	width, err := lengthInches(c.Width)
+	if err != nil {
+		return fmt.Errorf("chart width: %w", err)
+	}
+	height, err := lengthInches(c.Height)
+	if err != nil {
+		return fmt.Errorf("chart height: %w", err)
+	}
+	width, height = width*2.54, height*2.54
+
+	left, right := chartTickLabel, width-chartMargin
+	top, bottom := chartMargin, height-chartCategory
+	if c.YLabel != "" {
+		left += chartAxisLabel
+	}
+	if c.XLabel != "" {
+		bottom -= chartAxisLabel
+	}
+	if len(c.Series) > 1 {
+		top += chartLegend
+	}
+	if right <= left || bottom <= top {
+		return errors.New("chart too small")
+	}
+
+	low, high := 0.0, 0.0
+	for _, s := range c.Series {
+		for _, v := range s.Values {
+			low, high = min(low, v), max(high, v)
+		}
+	}
+	low, high, step := niceScale(low, high)
+	y := func(v float64) float64 {
+		return bottom - (v-low)/(high-low)*(bottom-top)
+	}
+
+	_, _ = w.WriteString("box")
+	_, _ = w.WriteString("(")
+	_, _ = w.WriteString("width: ")
+	_, _ = w.WriteString(cm(width))
+	_, _ = w.WriteString(", ")
+	_, _ = w.WriteString("height: ")
+	_, _ = w.WriteString(cm(height))
+	_, _ = w.WriteString(", ")
+	_, _ = w.WriteString("{\n")
+
+	_, _ = w.WriteString("set text(size: papermark-chart-text-size)\n")
+
+	// Grid lines and tick labels.
+	for v := low; v <= high+step/2; v += step {
+		chartLineWrite(w, left, y(v), right, y(v), "papermark-chart-grid")
+		chartLabelWrite(w, 0, y(v)-0.3, left-0.15, 0.6, "right + horizon", formatTick(v, step))
+	}
+
+	n := float64(len(c.Categories))
+	band := (right - left) / n
+	for i, category := range c.Categories {
+		chartLabelWrite(w, left+float64(i)*band, bottom+0.1, band, chartCategory-0.1, "center + top", category)
+	}
+
+	for j, s := range c.Series {
+		color := fmt.Sprintf("papermark-chart-palette.at(calc.rem(%d, papermark-chart-palette.len()))", j)
+		switch c.Type {
+		case "bar":
+			bar := band * (1 - 2*chartBarPadding) / float64(len(c.Series))
+			for i, v := range s.Values {
+				x := left + float64(i)*band + band*chartBarPadding + float64(j)*bar
+				y0, y1 := y(max(v, 0)), y(min(v, 0))
+				_, _ = fmt.Fprintf(w, "place(dx: %s, dy: %s, rect(width: %s, height: %s, fill: %s))\n", cm(x), cm(y0), cm(bar), cm(y1-y0), color)
+			}
+		case "line":
+			for i := range s.Values {
+				x := left + (float64(i)+0.5)*band
+				if i > 0 {
+					chartLineWrite(w, x-band, y(s.Values[i-1]), x, y(s.Values[i]), "papermark-chart-stroke + "+color)
+				}
+				_, _ = fmt.Fprintf(w, "place(dx: %s, dy: %s, circle(radius: %s, fill: %s))\n", cm(x-chartMarker), cm(y(s.Values[i])-chartMarker), cm(chartMarker), color)
+			}
+		}
+	}
+
+	// Axes.
+	chartLineWrite(w, left, top, left, bottom, "papermark-chart-stroke")
+	chartLineWrite(w, left, y(max(low, 0)), right, y(max(low, 0)), "papermark-chart-stroke")
+
+	if c.XLabel != "" {
+		chartLabelWrite(w, left, height-chartAxisLabel, right-left, chartAxisLabel, "center + horizon", c.XLabel)
+	}
+	if c.YLabel != "" {
+		_, _ = fmt.Fprintf(w, "place(dx: %s, dy: %s, rotate(-90deg, reflow: true, box(width: %s, height: %s, align(center + horizon)[", cm(0), cm(top), cm(bottom-top), cm(chartAxisLabel))
+		contentWrite(w, []byte(c.YLabel))
+		_, _ = w.WriteString("])))\n")
+	}
+
+	if len(c.Series) > 1 {
+		x := left
+		for j, s := range c.Series {
+			color := fmt.Sprintf("papermark-chart-palette.at(calc.rem(%d, papermark-chart-palette.len()))", j)
+			_, _ = fmt.Fprintf(w, "place(dx: %s, dy: %s, square(size: %s, fill: %s))\n", cm(x), cm(chartMargin+0.15), cm(0.3), color)
+			x += 0.45
+			label := s.Name
+			labelWidth := 0.25*float64(len([]rune(label))) + 0.3
+			chartLabelWrite(w, x, chartMargin, labelWidth, 0.6, "left + horizon", label)
+			x += labelWidth
+		}
+	}
+
+	_, _ = w.WriteString("}")
+	_, _ = w.WriteString(")")
+	return nil
+}
+
+func chartLineWrite(w util.BufWriter, x0, y0, x1, y1 float64, stroke string) {
+	_, _ = fmt.Fprintf(w, "place(line(start: (%s, %s), end: (%s, %s), stroke: %s))\n", cm(x0), cm(y0), cm(x1), cm(y1), stroke)
+}
+
+func chartLabelWrite(w util.BufWriter, x, y, width, height float64, align, label string) {
+	_, _ = fmt.Fprintf(w, "place(dx: %s, dy: %s, box(width: %s, height: %s, align(%s)[", cm(x), cm(y), cm(width), cm(height), align)
+	contentWrite(w, []byte(label))
+	_, _ = w.WriteString("]))\n")
+}
+
+func cm(v float64) string {
+	return strconv.FormatFloat(math.Round(v*1000)/1000, 'f', -1, 64) + "cm"
+}
+
+// niceScale widens [low, high] to round bounds with about five steps of
+// 1, 2 or 5 times a power of ten.
+func niceScale(low, high float64) (float64, float64, float64) {
+	if high == low {
+		high = low + 1
+	}
+	raw := (high - low) / 5
+	magnitude := math.Pow(10, math.Floor(math.Log10(raw)))
+	step := 10 * magnitude
+	for _, m := range []float64{1, 2, 5} {
+		if raw <= m*magnitude {
+			step = m * magnitude
+			break
+		}
+	}
+	return math.Floor(low/step) * step, math.Ceil(high/step) * step, step
+}
+
+func formatTick(v, step float64) string {
+	decimals := max(0, -int(math.Floor(math.Log10(step))))
+	return strconv.FormatFloat(v, 'f', decimals, 64)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultDiagramCommands are the commands diagram fences are rendered with
+// unless configured otherwise.
+var DefaultDiagramCommands = map[string]string{
+	"dot":      "dot -Tsvg",
+	"graphviz": "dot -Tsvg",
+	"plantuml": "plantuml -tsvg -pipe",
+	"mermaid":  "mmdc --input - --output - --outputFormat svg",
+}
+
+// Diagrams renders fenced code blocks to images with external tools.
+// Commands maps fence languages to command lines, which read the diagram
+// source from stdin and write SVG or PNG to stdout. They run in Dir, the
+// directory of the document with the diagram, so that the diagram can
+// refer to files next to it. Results are cached in CacheDir by a hash of
+// the command and the source.
+type Diagrams struct {
+	CacheDir string
+	Commands map[string]string
+	Dir      string
+}
+
+// errToolMissing is returned by Diagrams.Render when the command isn't
+// installed.
+var errToolMissing = errors.New("tool missing")
+
+const diagramTimeout = time.Minute
+
+// Render returns the path of the image rendered from source in the
+// fence language lang.
+func (d *Diagrams) Render(lang string, source []byte) (string, error) {
+	command := d.Commands[lang]
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", fmt.Errorf("no command for %s", lang)
+	}
+
+	hash := sha256.New()
+	_, _ = hash.Write([]byte(command))
+	_, _ = hash.Write([]byte{0})
+	_, _ = hash.Write(source)
+	key := hex.EncodeToString(hash.Sum(nil))
+	for _, ext := range []string{".svg", ".png"} {
+		cached := filepath.Join(d.CacheDir, key+ext)
+		if _, err := os.Stat(cached); err == nil {
+			return cached, nil
+		}
+	}
+
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return "", fmt.Errorf("%s: %w", args[0], errToolMissing)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), diagramTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = d.Dir
+	cmd.Stdin = bytes.NewReader(source)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	ext := ".svg"
+	if bytes.HasPrefix(stdout.Bytes(), []byte("\x89PNG")) {
+		ext = ".png"
+	}
+	cached := filepath.Join(d.CacheDir, key+ext)
+	err = cacheWrite(cached, stdout.Bytes())
+	if err != nil {
+		return "", err
+	}
+	return cached, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultExecCommands are the commands executable code blocks are run
+// with unless configured otherwise.
+var DefaultExecCommands = map[string]string{
+	"go":         "go run",
+	"python":     "python3",
+	"py":         "python3",
+	"sh":         "sh",
+	"bash":       "bash",
+	"javascript": "node",
+	"js":         "node",
+}
+
+// execExtensions maps languages to the extensions of the files their code
+// is written to when the language isn't an extension itself.
+var execExtensions = map[string]string{
+	"python":     ".py",
+	"bash":       ".sh",
+	"javascript": ".js",
+}
+
+// Executor runs the code of executable code blocks. Commands maps fence
+// languages to command lines, which get the path of a file with the code
+// as their last argument and run in a temporary directory. Outputs are
+// cached in CacheDir by a hash of the command, the code and the expected
+// exit code, so unchanged blocks aren't run again.
+type Executor struct {
+	CacheDir string
+	Commands map[string]string
+	Timeout  time.Duration
+}
+
+// Run runs code in language lang and returns its combined stdout and
+// stderr. It fails unless the code exits with the exit code.
+func (e *Executor) Run(lang string, code []byte, exit int) ([]byte, error) {
+	command := e.Commands[lang]
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("no command for %s", lang)
+	}
+
+	hash := sha256.New()
+	_, _ = hash.Write([]byte(command))
+	_, _ = hash.Write([]byte{0})
+	_, _ = hash.Write(code)
+	_, _ = hash.Write([]byte{0})
+	_, _ = hash.Write([]byte(strconv.Itoa(exit)))
+	cached := filepath.Join(e.CacheDir, hex.EncodeToString(hash.Sum(nil))+".out")
+	if output, err := os.ReadFile(cached); err == nil {
+		return output, nil
+	}
+
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return nil, fmt.Errorf("%s: %w", args[0], errToolMissing)
+	}
+
+	dir, err := os.MkdirTemp("", "papermark-exec-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	ext, ok := execExtensions[lang]
+	if !ok {
+		ext = "." + lang
+	}
+	err = os.WriteFile(filepath.Join(dir, "main"+ext), code, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.Timeout)
+	defer cancel()
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], append(args[1:], "main"+ext)...)
+	cmd.Dir = dir
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	killProcessGroup(cmd)
+	// Don't wait for leftover processes that keep the output open.
+	cmd.WaitDelay = time.Second
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("%s: timed out after %v", args[0], e.Timeout)
+	}
+	status := 0
+	if exitErr := (*exec.ExitError)(nil); errors.As(err, &exitErr) {
+		status = exitErr.ExitCode()
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: %w", args[0], err)
+	}
+	if status != exit {
+		return nil, fmt.Errorf("%s: exit status %d, want %d: %s", args[0], status, exit, bytes.TrimSpace(output.Bytes()))
+	}
+
+	err = cacheWrite(cached, output.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return output.Bytes(), nil
+}
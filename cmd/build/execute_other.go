@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// killProcessGroup leaves cmd as is where process groups aren't
+// available; only the process itself is killed.
+func killProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//go:embed mono.tmTheme
+var monoThemeBytes []byte
+
+// builtinThemes are the syntax highlighting themes that can be chosen by
+// name instead of a .tmTheme file. The mono theme prints well in black
+// and white: it sets keywords in bold and comments in italic gray.
+var builtinThemes = map[string][]byte{
+	"mono": monoThemeBytes,
+}
+
+// ThemeFile returns the path of the .tmTheme file for theme, which is a
+// built-in theme name or a path. Built-in themes are written to cacheDir
+// so that Typst can read them.
+func ThemeFile(theme, cacheDir string) (string, error) {
+	if data, ok := builtinThemes[theme]; ok {
+		sum := sha256.Sum256(data)
+		cached := filepath.Join(cacheDir, hex.EncodeToString(sum[:])+".tmTheme")
+		if _, err := os.Stat(cached); err == nil {
+			return cached, nil
+		}
+		err := cacheWrite(cached, data)
+		if err != nil {
+			return "", err
+		}
+		return cached, nil
+	}
+
+	if !strings.HasSuffix(theme, ".tmTheme") {
+		return "", fmt.Errorf("unknown theme %s, want mono or a .tmTheme file", theme)
+	}
+	return absFile(theme)
+}
+
+// SyntaxFile returns the absolute path of a .sublime-syntax file.
+func SyntaxFile(syntax string) (string, error) {
+	if !strings.HasSuffix(syntax, ".sublime-syntax") {
+		return "", fmt.Errorf("syntax %s: want a .sublime-syntax file", syntax)
+	}
+	return absFile(syntax)
+}
+
+// absFile returns the absolute path of the file at path after checking
+// that it exists.
+func absFile(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ReadListing reads the code of a listing included from the file at path.
+// lines selects line ranges such as 10-42 or 1-3,8-, and region selects
+// the lines between region name and endregion name marker comments, which
+// are themselves left out. Either may be empty to take the whole file.
+// Selected lines are dedented by their common indentation.
+func ReadListing(path, lines, region string) ([]byte, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if lines != "" {
+		code, err = selectLines(code, lines)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if region != "" {
+		code, err = selectRegion(code, region)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if lines != "" || region != "" {
+		code = dedent(code)
+	}
+	return code, nil
+}
+
+// listingLanguage returns the raw language of a file from its extension,
+// or its name for files such as Makefile that have none.
+func listingLanguage(path string) string {
+	if ext := filepath.Ext(path); ext != "" {
+		return ext[1:]
+	}
+	return filepath.Base(path)
+}
+
+// splitLines splits code into lines that keep their line endings.
+func splitLines(code []byte) [][]byte {
+	lines := bytes.SplitAfter(code, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// selectLines returns the lines of code in a comma-separated list of
+// 1-based inclusive ranges. Either end of a range may be left out.
+func selectLines(code []byte, ranges string) ([]byte, error) {
+	lines := splitLines(code)
+	rs, err := parseLineRanges(ranges, 1, len(lines))
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	for _, r := range rs {
+		for _, l := range lines[r[0]-1 : r[1]] {
+			b.Write(l)
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// parseLineRanges parses a comma-separated list of inclusive line ranges
+// such as 10-12,15 within lines first to last. A range without a start
+// begins at first and one without an end stops at last.
+func parseLineRanges(ranges string, first, last int) ([][2]int, error) {
+	var rs [][2]int
+	for _, r := range strings.Split(ranges, ",") {
+		from, to, isRange := strings.Cut(strings.TrimSpace(r), "-")
+		if !isRange {
+			to = from
+		}
+		start, stop := first, last
+		var err error
+		if from != "" {
+			start, err = strconv.Atoi(from)
+			if err != nil {
+				return nil, fmt.Errorf("invalid line range %q", r)
+			}
+		}
+		if to != "" {
+			stop, err = strconv.Atoi(to)
+			if err != nil {
+				return nil, fmt.Errorf("invalid line range %q", r)
+			}
+		}
+		if start > stop {
+			return nil, fmt.Errorf("invalid line range %q", r)
+		}
+		if start < first || stop > last {
+			return nil, fmt.Errorf("line range %q out of range %d-%d", r, first, last)
+		}
+		rs = append(rs, [2]int{start, stop})
+	}
+	return rs, nil
+}
+
+// regionPattern matches region marker comments such as // region name,
+// # endregion name and <!-- #region name -->.
+var regionPattern = regexp.MustCompile(`^\s*(?://|#|--|;|%|/\*|<!--)\s*#?(end)?region\b[ \t]*([\w.-]*)`)
+
+// selectRegion returns the lines of code in the named region without the
+// marker lines of the region and of the regions nested in it. A bare
+// endregion closes the innermost open region. A region that isn't closed
+// is an error, since its end was likely mistyped.
+func selectRegion(code []byte, name string) ([]byte, error) {
+	var b bytes.Buffer
+	inside := false
+	depth := 0
+	for _, l := range splitLines(code) {
+		m := regionPattern.FindSubmatch(l)
+		if !inside {
+			if m != nil && m[1] == nil && string(m[2]) == name {
+				inside = true
+			}
+			continue
+		}
+		if m == nil {
+			b.Write(l)
+			continue
+		}
+		switch {
+		case m[1] == nil:
+			depth++
+		case string(m[2]) == name || len(m[2]) == 0 && depth == 0:
+			return b.Bytes(), nil
+		default:
+			depth--
+		}
+	}
+	if inside {
+		return nil, fmt.Errorf("region %s not closed", name)
+	}
+	return nil, fmt.Errorf("region %s not found", name)
+}
+
+// dedent removes the leading whitespace common to the non-blank lines of
+// code.
+func dedent(code []byte) []byte {
+	lines := splitLines(code)
+	var indent []byte
+	first := true
+	for _, l := range lines {
+		if len(bytes.TrimSpace(l)) == 0 {
+			continue
+		}
+		i := len(l) - len(bytes.TrimLeft(l, " \t"))
+		if first {
+			indent, first = l[:i], false
+			continue
+		}
+		n := 0
+		for n < len(indent) && n < i && indent[n] == l[n] {
+			n++
+		}
+		indent = indent[:n]
+	}
+	if len(indent) == 0 {
+		return code
+	}
+
+	var b bytes.Buffer
+	for _, l := range lines {
+		if bytes.HasPrefix(l, indent) {
+			l = l[len(indent):]
+		} else {
+			l = bytes.TrimLeft(l, " \t")
+		}
+		b.Write(l)
+	}
+	return b.Bytes()
+}
+
+// Callout is a numbered marker at the end of a line of a listing, which
+// refers to an explanation in the ordered list after the listing.
+type Callout struct {
+	Line   int
+	Number int
+}
+
+// calloutPattern matches a callout marker comment such as // <1> or
+// <!-- <1> --> at the end of a line.
+var calloutPattern = regexp.MustCompile(`[ \t]*(?://|#|--|;|%|/\*|<!--)[ \t]*<(\d+)>[ \t]*(?:\*/|-->)?[ \t]*$`)
+
+// cutCallouts removes the callout markers from code and returns them with
+// 1-based line numbers.
+func cutCallouts(code []byte) ([]byte, []Callout) {
+	var b bytes.Buffer
+	var callouts []Callout
+	for i, l := range splitLines(code) {
+		line, eol := bytes.CutSuffix(l, []byte("\n"))
+		if m := calloutPattern.FindSubmatchIndex(line); m != nil {
+			number, _ := strconv.Atoi(string(line[m[2]:m[3]]))
+			callouts = append(callouts, Callout{Line: i + 1, Number: number})
+			line = line[:m[0]]
+		}
+		b.Write(line)
+		if eol {
+			b.WriteByte('\n')
+		}
+	}
+	if callouts == nil {
+		return code, nil
+	}
+	return b.Bytes(), callouts
+}
@@ -2,23 +2,73 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
+	"maps"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/yuin/goldmark"
 	"github.com/yuin/goldmark/extension"
 	"github.com/yuin/goldmark/parser"
 	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
 	"github.com/yuin/goldmark/util"
 )
 
 var (
-	outputFileFlag = flag.String("o", "", "output file")
-	sourceFileFlag = flag.String("s", "", "source file")
+	outputFileFlag       = flag.String("o", "", "output file")
+	sourceFileFlag       = flag.String("s", "", "source file")
+	cacheDirFlag         = flag.String("cache", "", "cache directory (default user cache directory)")
+	dpiFlag              = flag.Int("dpi", 300, "maximum image resolution, 0 to keep images as is")
+	execTimeoutFlag      = flag.Duration("exec-timeout", 10*time.Second, "time limit for running an executable code block")
+	themeFlag            = flag.String("theme", "", "syntax highlighting `theme`, mono or a .tmTheme file (default Typst's)")
+	headingShiftFlag     = flag.Int("shift-heading-level-by", 0, "`number` of levels to shift headings by, negative to promote them")
+	titleFromHeadingFlag = flag.Bool("title-from-heading", false, "use a lone level 1 heading as the document title and promote the other headings")
 )
 
+var syntaxFiles []string
+
+var (
+	diagramCommands = maps.Clone(DefaultDiagramCommands)
+	execCommands    = maps.Clone(DefaultExecCommands)
+)
+
+func init() {
+	flag.Func("diagram", "`lang=command` rendering fences in lang from stdin to SVG or PNG on stdout, empty command to show them as listings (repeatable)", func(s string) error {
+		lang, command, ok := strings.Cut(s, "=")
+		if !ok || lang == "" {
+			return errors.New("want lang=command")
+		}
+		if command == "" {
+			delete(diagramCommands, lang)
+		} else {
+			diagramCommands[lang] = command
+		}
+		return nil
+	})
+	flag.Func("exec", "`lang=command` running executable code blocks in lang, which get the code file as the last argument, empty command to not run them (repeatable)", func(s string) error {
+		lang, command, ok := strings.Cut(s, "=")
+		if !ok || lang == "" {
+			return errors.New("want lang=command")
+		}
+		if command == "" {
+			delete(execCommands, lang)
+		} else {
+			execCommands[lang] = command
+		}
+		return nil
+	})
+	flag.Func("syntax", "`.sublime-syntax` file defining a language for listings (repeatable)", func(s string) error {
+		syntaxFiles = append(syntaxFiles, s)
+		return nil
+	})
+}
+
 func main() {
 	flag.Parse()
 
@@ -41,22 +91,110 @@ func main() {
 		os.Exit(1)
 	}
 
-	err := run(outputFile, sourceFile, inputFile)
+	cacheDir := *cacheDirFlag
+	if cacheDir == "" {
+		userCacheDir, err := os.UserCacheDir()
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		cacheDir = filepath.Join(userCacheDir, "papermark")
+	}
+	// The asset root search walks up from the input file to the cached
+	// files, so the cache directory has to be absolute.
+	cacheDir, err := filepath.Abs(cacheDir)
 	if err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
-}
 
-func run(outputFile, sourceFile, inputFile string) error {
-	source, err := os.ReadFile(inputFile)
+	dpi := *dpiFlag
+	if dpi < 0 {
+		_, _ = fmt.Fprint(os.Stderr, "error: negative dpi flag\n")
+		os.Exit(1)
+	}
+
+	if *execTimeoutFlag <= 0 {
+		_, _ = fmt.Fprint(os.Stderr, "error: non-positive exec-timeout flag\n")
+		os.Exit(1)
+	}
+
+	rawStyle := &RawStyleExtension{}
+	if theme := *themeFlag; theme != "" {
+		themeFile, err := ThemeFile(theme, filepath.Join(cacheDir, "themes"))
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		rawStyle.Theme = themeFile
+	}
+	for _, syntax := range syntaxFiles {
+		syntaxFile, err := SyntaxFile(syntax)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		rawStyle.Syntaxes = append(rawStyle.Syntaxes, syntaxFile)
+	}
+
+	pipeline := &AssetPipeline{CacheDir: filepath.Join(cacheDir, "assets"), DPI: dpi}
+	diagrams := &Diagrams{CacheDir: filepath.Join(cacheDir, "diagrams"), Commands: diagramCommands}
+	executor := &Executor{CacheDir: filepath.Join(cacheDir, "exec"), Commands: execCommands, Timeout: *execTimeoutFlag}
+	styleDir := filepath.Join(cacheDir, "styles")
+	headingShift := &HeadingShiftExtension{InputFile: inputFile, Shift: *headingShiftFlag, TitleFromHeading: *titleFromHeadingFlag}
+	err = run(outputFile, sourceFile, inputFile, pipeline, diagrams, executor, styleDir, rawStyle, headingShift)
 	if err != nil {
-		return err
+		_, _ = fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
 	}
+}
 
+func run(outputFile, sourceFile, inputFile string, pipeline *AssetPipeline, diagrams *Diagrams, executor *Executor, styleDir string, rawStyle *RawStyleExtension, headingShift *HeadingShiftExtension) error {
 	var buf bytes.Buffer
-	converter := NewPapermark()
-	err = converter.Convert(source, &buf)
+	var newConverter func(inputFile string) goldmark.Markdown
+	newConverter = func(inputFile string) goldmark.Markdown {
+		return NewPapermark(
+			&ListingIncludeExtension{InputFile: inputFile},
+			&ExecExtension{InputFile: inputFile, Executor: executor},
+			&DiagramExtension{InputFile: inputFile, Diagrams: diagrams},
+			&BibliographyExtension{InputFile: inputFile, CacheDir: styleDir},
+			&AssetExtension{InputFile: inputFile, Pipeline: pipeline},
+			&IncludeExtension{InputFile: inputFile, NewConverter: newConverter},
+		)
+	}
+	// Included files are converted with their own converters. Extensions
+	// that work on the assembled document, across all files, are added to
+	// the top-level converter only.
+	converter := newConverter(inputFile)
+	rawStyle.Extend(converter)
+	headingShift.Extend(converter)
+	(&CrossReferenceExtension{InputFile: inputFile}).Extend(converter)
+	(&CitationKeyExtension{InputFile: inputFile}).Extend(converter)
+
+	// A book manifest isn't converted itself, its chapters are.
+	var source []byte
+	if isManifest(inputFile) {
+		book, err := ReadBook(inputFile)
+		if err != nil {
+			return err
+		}
+		(&BookExtension{InputFile: inputFile, Book: book, NewConverter: newConverter}).Extend(converter)
+	} else {
+		var err error
+		source, err = os.ReadFile(inputFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	pc := parser.NewContext()
+	pc.Set(inputFileKey, inputFile)
+	doc := converter.Parser().Parse(text.NewReader(source), parser.WithContext(pc))
+	err := parseErrors(pc)
+	if err != nil {
+		return err
+	}
+	err = converter.Renderer().Render(&buf, source, doc)
 	if err != nil {
 		return err
 	}
@@ -68,27 +206,35 @@ func run(outputFile, sourceFile, inputFile string) error {
 		}
 	}
 
-	typst := exec.Command("typst", "compile", "-", outputFile)
+	typst := exec.Command("typst", "compile", "--root", assetRoot(pc), "-", outputFile)
 	typst.Stdin = &buf
 	typst.Stdout = os.Stdout
 	typst.Stderr = os.Stderr
 	return typst.Run()
 }
 
-func NewPapermark() goldmark.Markdown {
+func NewPapermark(extensions ...goldmark.Extender) goldmark.Markdown {
 	return goldmark.New(
 		goldmark.WithExtensions(
 			extension.Linkify,         // https://github.github.com/gfm/#autolinks-extension-
 			&TableExtension{},         // https://github.github.com/gfm/#tables-extension-
 			&StrikethroughExtension{}, // https://github.github.com/gfm/#strikethrough-extension-
 			&TaskCheckBoxExtension{},  // https://github.github.com/gfm/#task-list-items-extension-
+			&MetadataExtension{},
+			&LanguageExtension{},
+			&AttributeExtension{},
+			&InlineCodeExtension{},
+			&OutlineExtension{},
+			&CitationExtension{},
+			&AppendixExtension{},
+			&ChapterNumberingExtension{},
 			&ImageBlockExtension{},
+			&ChartBlockExtension{},
 			// TODO: Math.
 			// TODO: Footnotes (https://github.blog/changelog/2021-09-30-footnotes-now-supported-in-markdown-fields/).
 			// TODO: Wikilinks.
-			// TODO: Attributes.
-			// TODO: YAML metadata.
 		),
+		goldmark.WithExtensions(extensions...),
 		goldmark.WithRenderer(
 			renderer.NewRenderer(renderer.WithNodeRenderers(
 				util.Prioritized(NewRenderer(), 1000)),
@@ -138,11 +284,26 @@ func (e *TaskCheckBoxExtension) Extend(m goldmark.Markdown) {
 	))
 }
 
+// ChartBlockExtension draws charts from chart fences.
+type ChartBlockExtension struct{}
+
+func (e *ChartBlockExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithASTTransformers(
+			util.Prioritized(NewChartBlockASTTransformer(), -50),
+		),
+	)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(NewChartBlockRenderer(), 500),
+	))
+}
+
 type ImageBlockExtension struct{}
 
 func (e *ImageBlockExtension) Extend(m goldmark.Markdown) {
 	m.Parser().AddOptions(
 		parser.WithASTTransformers(
+			util.Prioritized(NewSVGBlockASTTransformer(), -50),
 			util.Prioritized(NewImageBlockASTTransformer(), 0),
 		),
 	)
@@ -150,3 +311,293 @@ func (e *ImageBlockExtension) Extend(m goldmark.Markdown) {
 		util.Prioritized(NewImageBlockRenderer(), 500),
 	))
 }
+
+// MetadataExtension reads the YAML front matter of a document into the
+// Metadata returned by documentMetadata.
+type MetadataExtension struct{}
+
+func (e *MetadataExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithBlockParsers(
+			util.Prioritized(NewFrontMatterParser(), 0),
+		),
+		parser.WithASTTransformers(
+			util.Prioritized(NewFrontMatterASTTransformer(), -200),
+		),
+	)
+}
+
+// InlineCodeExtension sets the language of inline code.
+type InlineCodeExtension struct{}
+
+func (e *InlineCodeExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithASTTransformers(
+			util.Prioritized(NewInlineCodeASTTransformer(), 0),
+		),
+	)
+}
+
+// OutlineExtension renders [[toc]], [[lof]] and [[lot]] directives and the
+// outlines switched on in the front matter.
+type OutlineExtension struct{}
+
+func (e *OutlineExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithASTTransformers(
+			util.Prioritized(NewOutlineASTTransformer(), 0),
+		),
+	)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(NewOutlineRenderer(), 500),
+	))
+}
+
+// CitationExtension parses Pandoc-style citations and renders them and
+// bibliographies.
+type CitationExtension struct{}
+
+func (e *CitationExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithInlineParsers(
+			util.Prioritized(NewCitationParser(), 150),
+		),
+	)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(NewCitationRenderer(), 500),
+	))
+}
+
+// AppendixExtension starts the appendices at an [[appendix]] directive or
+// at a heading with the appendix class. It registers the BookRenderer,
+// which also renders the parts and page breaks of BookExtension.
+type AppendixExtension struct{}
+
+func (e *AppendixExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithASTTransformers(
+			util.Prioritized(NewAppendixASTTransformer(), 150),
+		),
+	)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(NewBookRenderer(), 500),
+	))
+}
+
+// LanguageExtension sets the document language if the front matter
+// gives one. It comes first, before the outlines and chapter numbering.
+type LanguageExtension struct{}
+
+func (e *LanguageExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithASTTransformers(
+			util.Prioritized(NewLanguageASTTransformer(), 10),
+		),
+	)
+}
+
+// ChapterNumberingExtension numbers figures, tables, listings and
+// equations within chapters if the front matter asks for it.
+type ChapterNumberingExtension struct{}
+
+func (e *ChapterNumberingExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithASTTransformers(
+			util.Prioritized(NewChapterNumberingASTTransformer(), 0),
+		),
+	)
+}
+
+// AttributeExtension lets an attribute list paragraph such as
+// {#id .class key=value} set attributes of the block before it, an
+// attribute list at the end of a heading set attributes of the heading and
+// an attribute list right after an image set attributes of the image.
+type AttributeExtension struct{}
+
+func (e *AttributeExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithInlineParsers(
+			util.Prioritized(NewImageSizeParser(), 150),
+		),
+		parser.WithASTTransformers(
+			util.Prioritized(NewAttributeASTTransformer(), -100),
+		),
+	)
+}
+
+// AssetExtension resolves asset paths relative to the input file and
+// prepares images with Pipeline if it is set.
+type AssetExtension struct {
+	InputFile string
+	Pipeline  *AssetPipeline
+}
+
+func (e *AssetExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithASTTransformers(
+			util.Prioritized(NewAssetASTTransformer(e.InputFile, e.Pipeline), 100),
+		),
+	)
+}
+
+// ListingIncludeExtension loads the code of fenced code blocks with a
+// file attribute from files next to the input file.
+type ListingIncludeExtension struct {
+	InputFile string
+}
+
+func (e *ListingIncludeExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithASTTransformers(
+			util.Prioritized(NewListingIncludeASTTransformer(e.InputFile), -75),
+		),
+	)
+}
+
+// RawStyleExtension sets the syntax highlighting theme and additional
+// syntax definitions of raw text. Theme is a .tmTheme file and Syntaxes
+// are .sublime-syntax files.
+type RawStyleExtension struct {
+	Theme    string
+	Syntaxes []string
+}
+
+func (e *RawStyleExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithASTTransformers(
+			util.Prioritized(NewRawStyleASTTransformer(e.Theme, e.Syntaxes), 50),
+		),
+	)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(NewRawStyleRenderer(), 500),
+	))
+}
+
+// ExecExtension runs executable code blocks with Executor.
+type ExecExtension struct {
+	InputFile string
+	Executor  *Executor
+}
+
+func (e *ExecExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithASTTransformers(
+			util.Prioritized(NewExecASTTransformer(e.InputFile, e.Executor), -40),
+		),
+	)
+}
+
+// IncludeExtension transcludes the Markdown files named by include
+// directives, parsing them with converters from NewConverter.
+type IncludeExtension struct {
+	InputFile    string
+	NewConverter func(inputFile string) goldmark.Markdown
+}
+
+func (e *IncludeExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithASTTransformers(
+			util.Prioritized(NewIncludeASTTransformer(e.InputFile, e.NewConverter), 200),
+		),
+	)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(NewTransclusionRenderer(m.Renderer()), 500),
+	))
+}
+
+// BookExtension assembles a book from the chapters of Book, parsing them
+// with converters from NewConverter. InputFile is the manifest. It extends
+// a converter from NewPapermark, whose AppendixExtension registers the
+// BookRenderer.
+type BookExtension struct {
+	InputFile    string
+	Book         *Book
+	NewConverter func(inputFile string) goldmark.Markdown
+}
+
+func (e *BookExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithASTTransformers(
+			util.Prioritized(NewBookASTTransformer(e.InputFile, e.Book, e.NewConverter), 300),
+		),
+	)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(NewTransclusionRenderer(m.Renderer()), 500),
+	))
+}
+
+// CrossReferenceExtension turns links to headings of the files in the
+// build into cross-references.
+type CrossReferenceExtension struct {
+	InputFile string
+}
+
+func (e *CrossReferenceExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithASTTransformers(
+			util.Prioritized(NewCrossReferenceASTTransformer(e.InputFile), 400),
+		),
+	)
+}
+
+// BibliographyExtension puts the bibliography files listed in the front
+// matter, relative to the input file, at the end of the document. The
+// bundled citation style is written to CacheDir.
+type BibliographyExtension struct {
+	InputFile string
+	CacheDir  string
+}
+
+func (e *BibliographyExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithASTTransformers(
+			util.Prioritized(NewBibliographyASTTransformer(e.InputFile, e.CacheDir), 0),
+		),
+	)
+}
+
+// CitationKeyExtension checks that cited keys are in the bibliography.
+type CitationKeyExtension struct {
+	InputFile string
+}
+
+func (e *CitationKeyExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithASTTransformers(
+			util.Prioritized(NewCitationKeyASTTransformer(e.InputFile), 500),
+		),
+	)
+}
+
+// HeadingShiftExtension shifts the levels of the headings of all files and
+// can make a lone level 1 heading the title.
+type HeadingShiftExtension struct {
+	InputFile        string
+	Shift            int
+	TitleFromHeading bool
+}
+
+func (e *HeadingShiftExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithASTTransformers(
+			util.Prioritized(NewHeadingShiftASTTransformer(e.InputFile, e.Shift, e.TitleFromHeading), 350),
+		),
+	)
+}
+
+// DiagramExtension renders fenced code blocks with Diagrams, run in the
+// directory of the input file.
+type DiagramExtension struct {
+	InputFile string
+	Diagrams  *Diagrams
+}
+
+func (e *DiagramExtension) Extend(m goldmark.Markdown) {
+	diagrams := *e.Diagrams
+	diagrams.Dir = filepath.Dir(e.InputFile)
+	m.Parser().AddOptions(
+		parser.WithASTTransformers(
+			util.Prioritized(NewDiagramASTTransformer(e.InputFile, &diagrams), -50),
+		),
+	)
+}
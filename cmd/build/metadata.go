@@ -0,0 +1,74 @@
+package main
+
+import (
+	"github.com/yuin/goldmark/parser"
+	"gopkg.in/yaml.v3"
+)
+
+// Metadata is the YAML front matter of a document, which sits between
+// --- lines at its very start. Keys papermark doesn't know are ignored.
+type Metadata struct {
+	// Lang is the ISO 639 code of the document language, such as en. It
+	// picks the titles of outlines, appendices and the bibliography.
+	// Without it, the template's Russian is used.
+	Lang string `yaml:"lang"`
+
+	// InlineCodeLanguage is the language of inline code without one.
+	InlineCodeLanguage string `yaml:"inline-code-language"`
+
+	// TOC, LOF and LOT put a table of contents, a list of figures and a
+	// list of tables at the start of the document. TOCDepth limits the
+	// heading levels of the table of contents if it isn't 0.
+	TOC      bool `yaml:"toc"`
+	TOCDepth int  `yaml:"toc-depth"`
+	LOF      bool `yaml:"lof"`
+	LOT      bool `yaml:"lot"`
+
+	// ChapterNumbering numbers figures, tables, listings and equations
+	// within chapters, as in 2.3, instead of throughout the document.
+	ChapterNumbering bool `yaml:"chapter-numbering"`
+
+	// Bibliography lists the BibTeX or Hayagriva files of the references,
+	// relative to the document. A single file can be given as a string.
+	Bibliography StringList `yaml:"bibliography"`
+
+	// Appendices lists the files of the appendices, relative to the
+	// document, which are included at its end.
+	Appendices StringList `yaml:"appendices"`
+
+	// CSL is the citation style of the bibliography, a .csl file relative
+	// to the document or the name of a style built into Typst. Russian
+	// documents default to the bundled GOST R 7.0.5-2008 style and others
+	// to ieee.
+	CSL string `yaml:"csl"`
+}
+
+// StringList is a list of strings that can be written in YAML as a single
+// string as well.
+type StringList []string
+
+func (l *StringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = StringList{value.Value}
+		return nil
+	}
+	var list []string
+	err := value.Decode(&list)
+	if err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+var metadataKey = parser.NewContextKey()
+
+// documentMetadata returns the front matter read while parsing, or empty
+// metadata if the document has none.
+func documentMetadata(pc parser.Context) *Metadata {
+	m, ok := pc.Get(metadataKey).(*Metadata)
+	if !ok {
+		return &Metadata{}
+	}
+	return m
+}
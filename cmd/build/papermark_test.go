@@ -1,8 +1,20 @@
 package main
 
 import (
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"golang.org/x/image/bmp"
 )
 
 func TestPapermark(t *testing.T) {
@@ -11,11 +23,12 @@ func TestPapermark(t *testing.T) {
 	tests := []struct {
 		Markdown  string
 		WantTypst string
+		WantErr   string
 	}{
 		// Hard line breaks
 		{Markdown: "foo  \nbaz\n", WantTypst: "foo \\\nbaz\n"},
 		{Markdown: "*foo  \nbar*\n", WantTypst: "#emph[foo \\\nbar];\n"},
-		{Markdown: "`code  \nspan`\n", WantTypst: "#raw(\"code   span\");\n"},
+		{Markdown: "`code  \nspan`\n", WantTypst: "#raw(block: false, \"code   span\");\n"},
 		{Markdown: "<a href=\"foo  \nbar\">\n", WantTypst: "\n"},
 		{Markdown: "foo  \n", WantTypst: "foo\n"},
 		{Markdown: "### foo  \n", WantTypst: "=== foo\n"},
@@ -27,18 +40,749 @@ func TestPapermark(t *testing.T) {
 		// If expression wasn't terminated with ';' and '.' wasn't escaped,
 		// ".body" would be interpreted as part of the expression.
 		{Markdown: "*foo*.body\n", WantTypst: "#emph[foo];\\.body\n"},
+
+		// Inline code
+		{Markdown: "`fmt.Println()`{.go} prints.\n", WantTypst: "#raw(block: false, lang: \"go\", \"fmt.Println()\"); prints\\.\n"},
+		{Markdown: "---\ninline-code-language: go\n---\n`x` and `y`{.sh}\n", WantTypst: "#raw(block: false, lang: \"go\", \"x\"); and #raw(block: false, lang: \"sh\", \"y\");\n"},
+
+		// Block attributes
+		{Markdown: "| a |\n| - |\n\n{#tbl .fit caption=\"Wide.\"}\n", WantTypst: "#figure(\ncaption: \"Wide.\",\nkind: table,\npapermark-fit(\ntable(\ncolumns: (auto),\nalign: (auto),\ntable.header([a]),\n),\n),\n);\n#label(\"tbl\");\n"},
+		{Markdown: "![](a.png)\n\n{.landscape}\n", WantTypst: "#page(flipped: true)[\n#figure(\n[#image(\"a.png\");],\n);\n];\n"},
+		{Markdown: "foo\n\n{bar}\n", WantTypst: "foo\n\n{bar}\n"},
+		{Markdown: "foo\n\n{=x}\n", WantErr: "main.md:3: attributes {=x}: attribute without a name"},
+		{Markdown: "![](a.png){=x}\n", WantErr: "main.md:1: attributes {=x}: attribute without a name"},
+		{Markdown: "# Title {=x}\n", WantErr: "main.md:1: attributes {=x}: attribute without a name"},
+		{Markdown: "```go =x\n```\n", WantErr: "main.md:1: attributes =x: attribute without a name"},
+
+		// Images
+		{Markdown: "![A *lake*](a.png \"Lake.\")\n", WantTypst: "#figure(\ncaption: \"Lake.\",\n[#image(\"a.png\", alt: \"A lake\");],\n);\n"},
+		{Markdown: "![](a.png){width=50% height=2cm fit=cover}\n", WantTypst: "#figure(\n[#image(\"a.png\", width: 50%, height: 2cm, fit: \"cover\");],\n);\n"},
+		{Markdown: "![](a.png =400x)\n", WantTypst: "#figure(\n[#image(\"a.png\", width: 300pt);],\n);\n"},
+		{Markdown: "![](a.png =x3cm \"Lake.\"){caption=\"Pond.\"}\n", WantTypst: "#figure(\ncaption: \"Pond.\",\n[#image(\"a.png\", height: 3cm);],\n);\n"},
+		{Markdown: "Press ![Enter](enter.svg) now.\n", WantTypst: "Press #box(image(\"enter.svg\", alt: \"Enter\", height: 1em)); now\\.\n"},
+		{Markdown: "Logo ![](logo.png){width=2cm}\n", WantTypst: "Logo #box(image(\"logo.png\", width: 2cm));\n"},
+		{Markdown: "Text.\n\n![](a.png){width=wide}\n", WantErr: "main.md:3: image a.png: width: invalid length \"wide\""},
+		{Markdown: "See ![](a.png){fit=fill}.\n", WantErr: "main.md:1: image a.png: fit: invalid value \"fill\", want cover, contain or stretch"},
+		{Markdown: "![](a.png){.nofigure caption=\"Ignored.\"}\n", WantTypst: "#align(center)[#image(\"a.png\");];\n"},
+		{Markdown: "![](a.png){.nofigure .fit}\n", WantTypst: "#align(center)[#papermark-fit[#image(\"a.png\");];];\n"},
+		{Markdown: "![](a.png){.fit}\n", WantTypst: "#figure(\npapermark-fit[#image(\"a.png\");],\n);\n"},
+
+		// Embedded images
+		{Markdown: "```svg {caption=\"Dot.\"}\n<svg/>\n```\n", WantTypst: "#figure(\ncaption: \"Dot.\",\n[#image(bytes(\"<svg/>\\n\"), format: \"svg\");],\n);\n"},
+		{Markdown: "![](data:image/svg+xml,%3Csvg/%3E)\n", WantTypst: "#figure(\n[#image(bytes(\"<svg/>\"), format: \"svg\");],\n);\n"},
+		{Markdown: "![](data:image/png;base64,iVBORw==)\n", WantTypst: "#figure(\n[#image(bytes((137, 80, 78, 71)), format: \"png\");],\n);\n"},
+
+		// Sub-figures
+		{Markdown: "![A](a.png)\n![B](b.png){#b}\n\n{caption=\"Both.\"}\n", WantTypst: "#figure(\ncaption: \"Both.\",\nkind: image,\n[#grid(\ncolumns: 2,\ngutter: 1em,\n[#figure(\nkind: \"subfigure\",\nsupplement: none,\nnumbering: \"(a)\",\ncaption: \"A\",\n[#image(\"a.png\", alt: \"A\");],\n);],\n[#figure(\nkind: \"subfigure\",\nsupplement: none,\nnumbering: \"(a)\",\ncaption: \"B\",\n[#image(\"b.png\", alt: \"B\");],\n);\n#label(\"b\");],\n);],\n);\n"},
+		{Markdown: "![](a.png) ![](b.png)\n\n{.nofigure}\n", WantTypst: "#align(center)[#grid(\ncolumns: 2,\ngutter: 1em,\n[#image(\"a.png\");],\n[#image(\"b.png\");],\n);];\n"},
+
+		// Charts
+		{Markdown: "```chart\nA,B\nx,1\n```\n", WantTypst: "#figure(\nkind: image,\nbox(width: 17cm, height: 8cm, {\nset text(size: papermark-chart-text-size)\nplace(line(start: (1.5cm, 7.1cm), end: (16.7cm, 7.1cm), stroke: papermark-chart-grid))\nplace(dx: 0cm, dy: 6.8cm, box(width: 1.35cm, height: 0.6cm, align(right + horizon)[0\\.0]))\nplace(line(start: (1.5cm, 5.74cm), end: (16.7cm, 5.74cm), stroke: papermark-chart-grid))\nplace(dx: 0cm, dy: 5.44cm, box(width: 1.35cm, height: 0.6cm, align(right + horizon)[0\\.2]))\nplace(line(start: (1.5cm, 4.38cm), end: (16.7cm, 4.38cm), stroke: papermark-chart-grid))\nplace(dx: 0cm, dy: 4.08cm, box(width: 1.35cm, height: 0.6cm, align(right + horizon)[0\\.4]))\nplace(line(start: (1.5cm, 3.02cm), end: (16.7cm, 3.02cm), stroke: papermark-chart-grid))\nplace(dx: 0cm, dy: 2.72cm, box(width: 1.35cm, height: 0.6cm, align(right + horizon)[0\\.6]))\nplace(line(start: (1.5cm, 1.66cm), end: (16.7cm, 1.66cm), stroke: papermark-chart-grid))\nplace(dx: 0cm, dy: 1.36cm, box(width: 1.35cm, height: 0.6cm, align(right + horizon)[0\\.8]))\nplace(line(start: (1.5cm, 0.3cm), end: (16.7cm, 0.3cm), stroke: papermark-chart-grid))\nplace(dx: 0cm, dy: -0cm, box(width: 1.35cm, height: 0.6cm, align(right + horizon)[1\\.0]))\nplace(dx: 1.5cm, dy: 7.2cm, box(width: 15.2cm, height: 0.8cm, align(center + top)[x]))\nplace(dx: 3.02cm, dy: 0.3cm, rect(width: 12.16cm, height: 6.8cm, fill: papermark-chart-palette.at(calc.rem(0, papermark-chart-palette.len()))))\nplace(line(start: (1.5cm, 0.3cm), end: (1.5cm, 7.1cm), stroke: papermark-chart-stroke))\nplace(line(start: (1.5cm, 7.1cm), end: (16.7cm, 7.1cm), stroke: papermark-chart-stroke))\n}),\n);\n"},
+		{Markdown: "```chart {type=pie}\nA,B\ntype: x,1\n```\n", WantErr: "main.md:1: chart: unknown chart type \"pie\", want bar or line"},
+		{Markdown: "```chart {type=pie}\ncategories: [a]\nseries:\n  - name: S\n    values: [1]\n```\n", WantErr: "main.md:1: chart: unknown chart type \"pie\", want bar or line"},
+
+		// Listings
+		{Markdown: "```go {start=9 highlight=10}\na()\nb()\n```\n", WantTypst: "#{\nshow raw.line: it => papermark-listing-line(it, numbered: true, start: 9, highlighted: (10,))\nraw(block: true, lang: \"go\", \"a()\\nb()\\n\")\n};\n"},
+		{Markdown: "```go {#lst:main caption=\"Main.\"}\nmain()\n```\n", WantTypst: "#figure(\ncaption: \"Main.\",\nkind: raw,\nraw(block: true, lang: \"go\", \"main()\\n\"),\n);\n#label(\"lst:main\");\n"},
+		{Markdown: "```sh\nmake # <1>\n```\n1. Builds.\n", WantTypst: "#{\nshow raw.line: it => papermark-listing-line(it, callouts: ((1, 1),))\nraw(block: true, lang: \"sh\", \"make\\n\")\n};\n\n#enum(\ntight: true,\nnumbering: papermark-callout,\n[Builds\\.],\n);\n"},
+
+		// Citations
+		{Markdown: "As shown [@knuth84, p. 12; @lamport94].\n", WantTypst: "As shown #cite(label(\"knuth84\"), supplement: \"p. 12\");#cite(label(\"lamport94\"));\\.\n"},
+		{Markdown: "@knuth84 says so.\n", WantTypst: "#cite(label(\"knuth84\"), form: \"prose\"); says so\\.\n"},
+		{Markdown: "[@knuth84](https://example.com)\n", WantTypst: "#link(\"https://example.com\")[\\@knuth84];\n"},
+
+		// Outlines
+		{Markdown: "[[toc]]{depth=2}\n\n# One\n\n[[lof]]\n[[lot]]\n", WantTypst: "#outline(title: papermark-outline-title(\"toc\"), depth: 2);\n\n= One\n\n#outline(title: papermark-outline-title(\"lof\"), target: figure.where(kind: image));\n\n#outline(title: papermark-outline-title(\"lot\"), target: figure.where(kind: table));\n"},
+		{Markdown: "---\ntoc: true\ntoc-depth: 1\nlot: true\n---\n# One\n\n[[lot]]\n", WantTypst: "#outline(title: papermark-outline-title(\"toc\"), depth: 1);\n\n= One\n\n#outline(title: papermark-outline-title(\"lot\"), target: figure.where(kind: table));\n"},
+		{Markdown: "Text.\n\n[[toc]]\n[[lof]]{depth=x}\n", WantErr: "main.md:4: lof: invalid depth \"x\""},
+		{Markdown: "---\nlof: true\n---\n", WantTypst: "#outline(title: papermark-outline-title(\"lof\"), target: figure.where(kind: image));\n"},
+
+		// Language
+		{Markdown: "---\nlang: en\nchapter-numbering: true\ntoc: true\n---\n# One\n", WantTypst: "#set text(lang: \"en\")\n\n#show: papermark-chapter-numbering\n\n#outline(title: papermark-outline-title(\"toc\"));\n\n= One\n"},
+		{Markdown: "---\nlang: \"en\\\")\"\n---\n", WantErr: "main.md:2: front matter: invalid lang \"en\\\")\""},
+
+		// Chapter numbering
+		{Markdown: "---\nchapter-numbering: true\n---\n# One\n", WantTypst: "#show: papermark-chapter-numbering\n\n= One\n"},
+		{Markdown: "---\nchapter-numbering: true\n---\n# Введение {-}\n\n![](a.png)\n\n# One\n", WantTypst: "#show: papermark-chapter-numbering\n\n#heading(level: 1, numbering: none)[Введение];\n\n#figure(\n[#image(\"a.png\");],\n);\n\n= One\n"},
+
+		// Appendices
+		{Markdown: "# Body\n\n[[appendix]]\n\n# Data\n", WantTypst: "= Body\n\n#show: papermark-appendices\n\n= Data\n"},
+		{Markdown: "# Body\n\n# Data {.appendix}\n\n[[appendix]]\n", WantTypst: "= Body\n\n#show: papermark-appendices\n\n= Data\n"},
+
+		// Links
+		{Markdown: "See [the *docs*](https://typst.app/docs/).\n", WantTypst: "See #link(\"https://typst.app/docs/\")[the #emph[docs];];\\.\n"},
+		{Markdown: "# Setup\n\n{#setup}\n", WantTypst: "= Setup\n#label(\"setup\");\n"},
+
+		// Heading attributes
+		{Markdown: "# Introduction {-}\n\nText.\n", WantTypst: "#heading(level: 1, numbering: none)[Introduction];\n\nText\\.\n"},
+		{Markdown: "## *Notes* {.unnumbered .unlisted #notes}\n", WantTypst: "#heading(level: 2, numbering: none, outlined: false)[#emph[Notes];];\n#label(\"notes\");\n"},
+		{Markdown: "# Methods {#methods}\n", WantTypst: "= Methods\n#label(\"methods\");\n"},
+		{Markdown: "# Sets {a, b}\n", WantTypst: "= Sets {a, b}\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Markdown, func(t *testing.T) {
+			testConvert(t, md, "main.md", tt.Markdown, tt.WantTypst, tt.WantErr)
+		})
+	}
+}
+
+func TestAssetExtension(t *testing.T) {
+	dir := t.TempDir()
+	inputFile := filepath.Join(dir, "doc", "main.md")
+	if err := os.MkdirAll(filepath.Join(dir, "doc"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "img"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "img", "a.png"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Markdown  string
+		WantTypst string
+		WantRoot  string
+		WantErr   string
+	}{
+		{Markdown: "![](../img/a.png)\n", WantTypst: "#figure(\n[#image(\"/img/a.png\");],\n);\n", WantRoot: dir},
+		{Markdown: "![](https://example.com/a.png)\n", WantTypst: "#figure(\n[#image(\"https://example.com/a.png\");],\n);\n", WantRoot: filepath.Join(dir, "doc")},
+		{Markdown: "Text.\n\nSee ![](b.png).\n", WantErr: inputFile + ":3: image b.png: no such file or directory"},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.Markdown, func(t *testing.T) {
-			b := new(strings.Builder)
-			err := md.Convert([]byte(tt.Markdown), b)
+			md := NewPapermark(&AssetExtension{InputFile: inputFile})
+			pc := testConvert(t, md, inputFile, tt.Markdown, tt.WantTypst, tt.WantErr)
+			if got, want := assetRoot(pc), tt.WantRoot; tt.WantErr == "" && got != want {
+				t.Fatalf("got %q root, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCommonRoot(t *testing.T) {
+	root := filepath.Join(string(filepath.Separator), "home", "doc")
+
+	tests := []struct {
+		Path     string
+		WantRoot string
+		WantErr  string
+	}{
+		{Path: filepath.Join(root, "img", "a.png"), WantRoot: root},
+		{Path: filepath.Join(string(filepath.Separator), "cache", "a.png"), WantRoot: string(filepath.Separator)},
+		{Path: filepath.Join("cache", "a.png"), WantErr: filepath.Join("cache", "a.png") + " is outside " + string(filepath.Separator)},
+	}
+
+	for _, tt := range tests {
+		got, err := commonRoot(root, tt.Path)
+		if err != nil || tt.WantErr != "" {
+			if err == nil || err.Error() != tt.WantErr {
+				t.Fatalf("got %v err for %s, want %s", err, tt.Path, tt.WantErr)
+			}
+			continue
+		}
+		if got != tt.WantRoot {
+			t.Fatalf("got %q for %s, want %q", got, tt.Path, tt.WantRoot)
+		}
+	}
+}
+
+func TestListingIncludeExtension(t *testing.T) {
+	dir := t.TempDir()
+	inputFile := filepath.Join(dir, "main.md")
+	writeFiles(t, dir, map[string]string{
+		"main.go": "package main\n\nfunc main() {\n\t// region greet\n\tprintln(\"hi\")\n\t// endregion greet\n}\n",
+		"open.go": "package main\n\n// region greet\nfunc greet() {}\n",
+	})
+	md := NewPapermark(&ListingIncludeExtension{InputFile: inputFile})
+
+	tests := []struct {
+		Markdown  string
+		WantTypst string
+		WantErr   string
+	}{
+		{Markdown: "``` {file=main.go lines=1}\n```\n", WantTypst: "#raw(block: true, lang: \"go\", \"package main\\n\");\n"},
+		{Markdown: "```text file=main.go lines=3-4,7\n```\n", WantTypst: "#raw(block: true, lang: \"text\", \"func main() {\\n\\t// region greet\\n}\\n\");\n"},
+		{Markdown: "```go file=main.go region=greet\n```\n", WantTypst: "#raw(block: true, lang: \"go\", \"println(\\\"hi\\\")\\n\");\n"},
+		{Markdown: "Text.\n\n```go file=missing.go\n```\n", WantErr: inputFile + ":3: listing missing.go: no such file or directory"},
+		{Markdown: "```go file=main.go region=other\n```\n", WantErr: inputFile + ":1: listing main.go: region other not found"},
+		{Markdown: "```go file=open.go region=greet\n```\n", WantErr: inputFile + ":1: listing open.go: region greet not closed"},
+		{Markdown: "```go file=main.go lines=5-9\n```\n", WantErr: inputFile + ":1: listing main.go: line range \"5-9\" out of range 1-7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Markdown, func(t *testing.T) {
+			testConvert(t, md, inputFile, tt.Markdown, tt.WantTypst, tt.WantErr)
+		})
+	}
+}
+
+func TestRawStyleExtension(t *testing.T) {
+	dir := t.TempDir()
+	inputFile := filepath.Join(dir, "doc", "main.md")
+	theme, err := ThemeFile("mono", filepath.Join(dir, "themes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ThemeFile("solarized", dir); err == nil {
+		t.Fatal("got nil err for unknown theme")
+	}
+
+	md := NewPapermark(
+		&AssetExtension{InputFile: inputFile},
+		&RawStyleExtension{Theme: theme, Syntaxes: []string{filepath.Join(dir, "doc", "dsl.sublime-syntax")}},
+	)
+	want := "#set raw(theme: \"/themes/" + filepath.Base(theme) + "\", syntaxes: (\"/doc/dsl.sublime-syntax\",));\n\nfoo\n"
+	pc := testConvert(t, md, inputFile, "foo\n", want, "")
+	if got, want := assetRoot(pc), dir; got != want {
+		t.Fatalf("got %q root, want %q", got, want)
+	}
+}
+
+func TestIncludeExtension(t *testing.T) {
+	dir := t.TempDir()
+	inputFile := filepath.Join(dir, "main.md")
+	files := map[string]string{
+		"sections/a.md":    "# A\n\n![](img.png)\n",
+		"sections/img.png": "",
+		"b.md":             "Shared *text*.\n",
+		"loop.md":          "!include loop.md\n",
+	}
+	writeFiles(t, dir, files)
+	newConverter := includeConverter(func(inputFile string) []goldmark.Extender {
+		return []goldmark.Extender{
+			&AssetExtension{InputFile: inputFile},
+		}
+	})
+	md := newConverter(inputFile)
+
+	tests := []struct {
+		Markdown  string
+		WantTypst string
+		WantErr   string
+	}{
+		{Markdown: "# Intro\n\n!include sections/a.md {shift=1}\n![[b]]\n\nEnd.\n", WantTypst: "= Intro\n\n== A\n\n#figure(\n[#image(\"/sections/img.png\");],\n);\n\nShared #emph[text];\\.\n\nEnd\\.\n"},
+		{Markdown: "---\nappendices: [b.md]\n---\nText.\n", WantTypst: "Text\\.\n\n#show: papermark-appendices\n\nShared #emph[text];\\.\n"},
+		{Markdown: "Text.\n\n!include missing.md\n", WantErr: inputFile + ":3: include missing.md: no such file or directory"},
+		{Markdown: "Text.\n\n!include b.md\n!include missing.md\n", WantErr: inputFile + ":4: include missing.md: no such file or directory"},
+		{Markdown: "!include loop.md\n", WantErr: filepath.Join(dir, "loop.md") + ":1: include loop.md: cycle " + inputFile + " -> " + filepath.Join(dir, "loop.md") + " -> " + filepath.Join(dir, "loop.md")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Markdown, func(t *testing.T) {
+			testConvert(t, md, inputFile, tt.Markdown, tt.WantTypst, tt.WantErr)
+		})
+	}
+}
+
+func TestBookExtension(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"intro.md":         "# Intro\n",
+		"theory/models.md": "# Models\n\n## Linear\n",
+		"theory/linear.md": "# Details\n\nText.\n",
+		"data.md":          "# Data\n\n![](data.png){#fig}\n",
+		"data.png":         "",
+		"more.md":          "![](data.png){#fig}\n",
+	}
+	writeFiles(t, dir, files)
+	newConverter := includeConverter(func(inputFile string) []goldmark.Extender {
+		return []goldmark.Extender{
+			&AssetExtension{InputFile: inputFile},
+		}
+	})
+
+	tests := []struct {
+		Manifest  string
+		WantTypst string
+		WantErr   string
+	}{
+		{
+			Manifest:  "# Summary\n\n- [Intro](intro.md)\n\n# Theory\n\n- [Models](theory/models.md)\n  - [Linear](theory/linear.md)\n\n# Appendices\n\n- [Data](data.md)\n",
+			WantTypst: "= Intro\n\n#papermark-part(\"Theory\");\n\n#pagebreak(weak: true);\n\n= Models\n\n== Linear\n\n== Details\n\nText\\.\n\n#show: papermark-appendices\n\n#pagebreak(weak: true);\n\n= Data\n\n#figure(\n[#image(\"/data.png\");],\n);\n#label(\"fig\");\n",
+		},
+		{
+			Manifest: "- [Intro](intro.md)\n- [Missing](missing.md)\n",
+			WantErr:  filepath.Join(dir, "SUMMARY.md") + ":2: chapter missing.md: no such file or directory",
+		},
+		{
+			Manifest: "- [Data](data.md)\n- [More](more.md)\n",
+			WantErr:  filepath.Join(dir, "more.md") + ":1: label fig already defined at " + filepath.Join(dir, "data.md") + ":3",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Manifest, func(t *testing.T) {
+			inputFile := filepath.Join(dir, "SUMMARY.md")
+			if err := os.WriteFile(inputFile, []byte(tt.Manifest), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			book, err := ReadBook(inputFile)
 			if err != nil {
 				t.Fatalf("got %v err", err)
 			}
-			if got, want := b.String(), tt.WantTypst; got != want {
-				t.Fatalf("got %q, want %q", got, want)
+			md := newConverter(inputFile)
+			(&BookExtension{InputFile: inputFile, Book: book, NewConverter: newConverter}).Extend(md)
+
+			testConvert(t, md, inputFile, "", tt.WantTypst, tt.WantErr)
+		})
+	}
+}
+
+func TestCrossReferenceExtension(t *testing.T) {
+	dir := t.TempDir()
+	inputFile := filepath.Join(dir, "main.md")
+	files := map[string]string{
+		"setup.md":      "# Setup\n\n## Installation\n\n## Installation\n\n## Usage\n\n{#use}\n",
+		"guide/more.md": "See [setup](../setup.md).\n",
+	}
+	writeFiles(t, dir, files)
+	newConverter := includeConverter(func(inputFile string) []goldmark.Extender {
+		return nil
+	})
+	md := newConverter(inputFile)
+	(&CrossReferenceExtension{InputFile: inputFile}).Extend(md)
+
+	tests := []struct {
+		Markdown  string
+		WantTypst string
+		WantErr   string
+	}{
+		{
+			Markdown:  "# Intro\n\n[Again](setup.md#installation-1), [use](setup.md#use), [top](#intro).\n\n!include setup.md {shift=1}\n!include guide/more.md\n",
+			WantTypst: "= Intro\n#label(\"intro\");\n\n#link(label(\"installation\"))[Again];, #link(label(\"use\"))[use];, #link(label(\"intro\"))[top];\\.\n\n== Setup\n#label(\"setup\");\n\n=== Installation\n\n=== Installation\n#label(\"installation\");\n\n=== Usage\n#label(\"use\");\n\nSee #link(label(\"setup\"))[setup];\\.\n",
+		},
+		{Markdown: "See [notes](notes.md#a).\n", WantTypst: "See notes\\.\n"},
+		{Markdown: "See [setup](setup.md#missing).\n\n!include setup.md\n", WantErr: inputFile + ":1: link setup.md#missing: no such heading"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Markdown, func(t *testing.T) {
+			testConvert(t, md, inputFile, tt.Markdown, tt.WantTypst, tt.WantErr)
+		})
+	}
+}
+
+func TestBibliographyExtension(t *testing.T) {
+	dir := t.TempDir()
+	inputFile := filepath.Join(dir, "main.md")
+	files := map[string]string{
+		"refs/refs.bib":  "@comment{ignored,}\n@book{knuth84,\n  title = {The TeXbook},\n}\n",
+		"refs/style.csl": "",
+		"refs/more.yml":  "lamport94:\n  type: book\n  title: LaTeX\n",
+		"chapter.md":     "---\nbibliography: refs/more.yml\n---\nSee @lamport94.\n",
+	}
+	writeFiles(t, dir, files)
+	gost, err := GOSTStyleFile(filepath.Join(dir, "styles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newConverter := includeConverter(func(inputFile string) []goldmark.Extender {
+		return []goldmark.Extender{
+			&BibliographyExtension{InputFile: inputFile, CacheDir: filepath.Join(dir, "styles")},
+			&AssetExtension{InputFile: inputFile},
+		}
+	})
+	md := newConverter(inputFile)
+	(&CitationKeyExtension{InputFile: inputFile}).Extend(md)
+
+	tests := []struct {
+		Markdown  string
+		WantTypst string
+		WantErr   string
+	}{
+		{
+			Markdown:  "---\nbibliography: [refs/refs.bib]\n---\nSee [@knuth84, p. 12].\n\n!include chapter.md\n",
+			WantTypst: "See #cite(label(\"knuth84\"), supplement: \"p. 12\");\\.\n\nSee #cite(label(\"lamport94\"), form: \"prose\");\\.\n\n#papermark-bibliography((\"/refs/more.yml\",\"/refs/refs.bib\",), style: \"/styles/" + filepath.Base(gost) + "\");\n",
+		},
+		{Markdown: "---\nbibliography: refs/refs.bib\nlang: en\n---\n", WantTypst: "#set text(lang: \"en\")\n\n#papermark-bibliography((\"/refs/refs.bib\",));\n"},
+		{Markdown: "---\nbibliography: refs/refs.bib\ncsl: refs/style.csl\n---\n", WantTypst: "#papermark-bibliography((\"/refs/refs.bib\",), style: \"/refs/style.csl\");\n"},
+		{Markdown: "---\nbibliography: refs/refs.bib\ncsl: apa\n---\n", WantTypst: "#papermark-bibliography((\"/refs/refs.bib\",), style: \"apa\");\n"},
+		{Markdown: "---\nbibliography: refs/refs.bib\n---\nSee @ignored.\n", WantErr: inputFile + ":4: citation ignored: no such key in the bibliography"},
+		{Markdown: "See [@knuth84].\n", WantTypst: "See \\[\\@knuth84\\]\\.\n"},
+		{Markdown: "Ask @john on the forum.\n", WantTypst: "Ask \\@john on the forum\\.\n"},
+		{Markdown: "---\nbibliography: missing.bib\n---\n", WantErr: inputFile + ": bibliography missing.bib: no such file or directory"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Markdown, func(t *testing.T) {
+			testConvert(t, md, inputFile, tt.Markdown, tt.WantTypst, tt.WantErr)
+		})
+	}
+}
+
+func TestHeadingShiftExtension(t *testing.T) {
+	tests := []struct {
+		Markdown         string
+		Shift            int
+		TitleFromHeading bool
+		WantTypst        string
+	}{
+		{Markdown: "# A\n\n## B\n", Shift: 1, WantTypst: "== A\n\n=== B\n"},
+		{Markdown: "# A\n\n## B\n", Shift: -1, WantTypst: "= A\n\n= B\n"},
+		{Markdown: "---\ntoc: true\n---\n# My *Title*\n\n## One\n\n### Two\n", TitleFromHeading: true, WantTypst: "#set document(title: \"My Title\");\n#papermark-title(\"My Title\");\n\n#outline(title: papermark-outline-title(\"toc\"));\n\n= One\n\n== Two\n"},
+		{Markdown: "# A\n\n# B\n", TitleFromHeading: true, WantTypst: "= A\n\n= B\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Markdown, func(t *testing.T) {
+			md := NewPapermark(&HeadingShiftExtension{Shift: tt.Shift, TitleFromHeading: tt.TitleFromHeading})
+			testConvert(t, md, "main.md", tt.Markdown, tt.WantTypst, "")
+		})
+	}
+}
+
+func TestReadBook(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Manifest string
+		Want     *Book
+		WantErr  bool
+	}{
+		{
+			Name:     "SUMMARY.md",
+			Manifest: "# Summary\n\n[Preface](preface.md)\n\n- [One](one.md)\n  - [Draft]()\n  - [Two](two.md)\n\n# Приложения\n\n- [A](a.md)\n",
+			Want: &Book{Parts: []BookPart{
+				{Chapters: []BookChapter{{File: "preface.md", Line: 3}, {File: "one.md", Line: 5}, {File: "two.md", Level: 1, Line: 7}}},
+				{Appendices: true, Chapters: []BookChapter{{File: "a.md", Line: 11}}},
+			}},
+		},
+		{
+			Name:     "book.yaml",
+			Manifest: "chapters: [intro.md]\nparts:\n  - title: Theory\n    chapters: [models.md]\nappendices: [data.md]\n",
+			Want: &Book{Parts: []BookPart{
+				{Chapters: []BookChapter{{File: "intro.md"}}},
+				{Title: "Theory", Chapters: []BookChapter{{File: "models.md"}}},
+				{Appendices: true, Chapters: []BookChapter{{File: "data.md"}}},
+			}},
+		},
+		{Name: "book.yaml", Manifest: "chapter: [intro.md]\n", WantErr: true},
+		{Name: "SUMMARY.md", Manifest: "# Summary\n", WantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Manifest, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.Name)
+			if err := os.WriteFile(path, []byte(tt.Manifest), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadBook(path)
+			if tt.WantErr {
+				if err == nil {
+					t.Fatalf("got %v, want err", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got %v err", err)
+			}
+			if !reflect.DeepEqual(got, tt.Want) {
+				t.Fatalf("got %+v, want %+v", got, tt.Want)
+			}
+		})
+	}
+}
+
+func TestAssetPipeline(t *testing.T) {
+	dir := t.TempDir()
+	pipeline := &AssetPipeline{CacheDir: filepath.Join(dir, "cache"), DPI: 100}
+
+	writeImage := func(name string, width, height int, encode func(io.Writer, image.Image) error) string {
+		t.Helper()
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := encode(f, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+			t.Fatal(err)
+		}
+		return f.Name()
+	}
+
+	tests := []struct {
+		Name       string
+		Path       string
+		Width      float64
+		WantCached bool
+		WantWidth  int
+	}{
+		{Name: "small png", Path: writeImage("small.png", 100, 50, png.Encode), Width: 2, WantWidth: 100},
+		{Name: "large png", Path: writeImage("large.png", 1000, 500, png.Encode), Width: 2, WantCached: true, WantWidth: 200},
+		{Name: "bmp", Path: writeImage("small.bmp", 100, 50, bmp.Encode), Width: 2, WantCached: true, WantWidth: 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			got, err := pipeline.Process(tt.Path, tt.Width, 0)
+			if err != nil {
+				t.Fatalf("got %v err", err)
+			}
+			if cached := got != tt.Path; cached != tt.WantCached {
+				t.Fatalf("got %q path, want cached %v", got, tt.WantCached)
+			}
+			f, err := os.Open(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			config, format, err := image.DecodeConfig(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != "png" {
+				t.Fatalf("got %s format, want png", format)
+			}
+			if config.Width != tt.WantWidth {
+				t.Fatalf("got %d width, want %d", config.Width, tt.WantWidth)
+			}
+			again, err := pipeline.Process(tt.Path, tt.Width, 0)
+			if err != nil || again != got {
+				t.Fatalf("got %q path and %v err on second run, want %q", again, err, got)
+			}
+		})
+	}
+}
+
+func TestExifOrientation(t *testing.T) {
+	// A JPEG prefix with an APP1 segment holding a big-endian EXIF IFD
+	// with a single orientation entry.
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00\x00\x00\x00\x00")
+	app1 := append([]byte("Exif\x00\x00"), tiff...)
+	data := append([]byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, byte(len(app1) + 2)}, app1...)
+	data = append(data, 0xFF, 0xDA)
+
+	if got, want := exifOrientation(data), 6; got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+
+	img := image.NewGray(image.Rect(0, 0, 2, 1))
+	img.Pix[0] = 255
+	got := orient(img, 6)
+	if b := got.Bounds(); b.Dx() != 1 || b.Dy() != 2 {
+		t.Fatalf("got %v bounds, want 1x2", b)
+	}
+	if r, _, _, _ := got.At(0, 0).RGBA(); r != 0xFFFF {
+		t.Fatalf("got %d top pixel, want white", r)
+	}
+}
+
+func TestDiagramExtension(t *testing.T) {
+	dir := t.TempDir()
+	diagrams := &Diagrams{
+		CacheDir: dir,
+		Commands: map[string]string{
+			"echo":    "cat",
+			"missing": "papermark-missing-tool",
+		},
+	}
+	md := NewPapermark(&DiagramExtension{InputFile: "main.md", Diagrams: diagrams})
+	echo, err := diagrams.Render("echo", []byte("<svg/>\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Markdown  string
+		WantTypst string
+	}{
+		{Markdown: "```echo {#fig:echo}\n<svg/>\n```\n", WantTypst: "#figure(\n[#image(\"" + echo + "\");],\n);\n#label(\"fig:echo\");\n"},
+		{Markdown: "```missing\nA -> B\n```\n", WantTypst: "#raw(block: true, lang: \"missing\", \"A -> B\\n\");\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Markdown, func(t *testing.T) {
+			testConvert(t, md, "main.md", tt.Markdown, tt.WantTypst, "")
+		})
+	}
+
+	// Diagrams run in the directory of the file they are in, which may be
+	// an included one.
+	writeFiles(t, dir, map[string]string{
+		"doc/sub/part.md":  "```side\nx\n```\n",
+		"doc/sub/side.svg": "<svg/>\n",
+	})
+	diagrams.Commands["side"] = "cat side.svg"
+	side, err := (&Diagrams{CacheDir: t.TempDir(), Commands: diagrams.Commands, Dir: filepath.Join(dir, "doc", "sub")}).Render("side", []byte("x\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputFile := filepath.Join(dir, "doc", "main.md")
+	md = includeConverter(func(inputFile string) []goldmark.Extender {
+		return []goldmark.Extender{&DiagramExtension{InputFile: inputFile, Diagrams: diagrams}}
+	})(inputFile)
+	testConvert(t, md, inputFile, "!include sub/part.md\n", "#figure(\n[#image(\""+filepath.Join(dir, filepath.Base(side))+"\");],\n);\n", "")
+}
+
+func TestExecExtension(t *testing.T) {
+	dir := t.TempDir()
+	executor := &Executor{
+		CacheDir: dir,
+		Commands: map[string]string{
+			"sh":      "sh",
+			"missing": "papermark-missing-tool",
+		},
+		Timeout: 10 * time.Second,
+	}
+	md := NewPapermark(&ExecExtension{InputFile: "main.md", Executor: executor})
+
+	tests := []struct {
+		Markdown  string
+		WantTypst string
+		WantErr   string
+	}{
+		{Markdown: "```sh {.exec}\necho hi\n```\n", WantTypst: "#raw(block: true, lang: \"sh\", \"echo hi\\n\");\n\n#raw(block: true, \"hi\\n\");\n"},
+		{Markdown: "```sh {.exec exit=2}\necho no >&2; exit 2\n```\n", WantTypst: "#raw(block: true, lang: \"sh\", \"echo no >&2; exit 2\\n\");\n\n#raw(block: true, \"no\\n\");\n"},
+		{Markdown: "```sh {.exec}\nexit 1\n```\n", WantErr: "main.md:1: exec: sh: exit status 1, want 0: "},
+		{Markdown: "```missing {.exec}\nx\n```\n", WantTypst: "#raw(block: true, lang: \"missing\", \"x\\n\");\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Markdown, func(t *testing.T) {
+			testConvert(t, md, "main.md", tt.Markdown, tt.WantTypst, tt.WantErr)
+		})
+	}
+
+	// Cached outputs are reused even if running the code would fail now.
+	output, err := executor.Run("sh", []byte("echo hi\n"), 0)
+	if err != nil || string(output) != "hi\n" {
+		t.Fatalf("got %q, %v err", output, err)
+	}
+	t.Setenv("PATH", "")
+	output, err = executor.Run("sh", []byte("echo hi\n"), 0)
+	if err != nil || string(output) != "hi\n" {
+		t.Fatalf("got %q, %v err from cache", output, err)
+	}
+}
+
+func TestExecTimeout(t *testing.T) {
+	executor := &Executor{CacheDir: t.TempDir(), Commands: map[string]string{"sh": "sh"}, Timeout: 100 * time.Millisecond}
+
+	// The sleep is a child of the shell and keeps the output open.
+	start := time.Now()
+	_, err := executor.Run("sh", []byte("sleep 10\necho done\n"), 0)
+	if err == nil || err.Error() != "sh: timed out after 100ms" {
+		t.Fatalf("got %v err", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("got %v elapsed", elapsed)
+	}
+}
+
+func TestParseChart(t *testing.T) {
+	tests := []struct {
+		Body    string
+		Want    *Chart
+		WantErr string
+	}{
+		{
+			Body: "Month,Savings\nJanuary,250\nFebruary,80\n",
+			Want: &Chart{Type: "bar", Width: "100%", Height: "8cm", Categories: []string{"January", "February"}, Series: []ChartSeries{{Name: "Savings", Values: []float64{250, 80}}}},
+		},
+		{
+			Body: "type: line\nheight: 5cm\n---\nYear, A, B\n2024, 1, 2\n",
+			Want: &Chart{Type: "line", Width: "100%", Height: "5cm", Categories: []string{"2024"}, Series: []ChartSeries{{Name: "A", Values: []float64{1}}, {Name: "B", Values: []float64{2}}}},
+		},
+		{
+			Body: "categories: [a, b]\nseries:\n  - name: S\n    values: [1.5, -2]\n",
+			Want: &Chart{Type: "bar", Width: "100%", Height: "8cm", Categories: []string{"a", "b"}, Series: []ChartSeries{{Name: "S", Values: []float64{1.5, -2}}}},
+		},
+		{Body: "type: pie\n---\nA,B\nx,1\n", WantErr: `unknown chart type "pie", want bar or line`},
+		{Body: "A,B\nx,one\n", WantErr: `chart data: strconv.ParseFloat: parsing "one": invalid syntax`},
+		{Body: "A,B\nx,1\ny,Inf\n", WantErr: `chart data: non-finite value "Inf"`},
+		{Body: "A,B\nx,NaN\n", WantErr: `chart data: non-finite value "NaN"`},
+		{Body: "categories: [a]\nseries:\n  - name: S\n    values: [.inf]\n", WantErr: `series "S" has non-finite value +Inf`},
+		{Body: "categories: [a, b]\nseries:\n  - name: S\n    values: [1]\n", WantErr: `series "S" has 1 values for 2 categories`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Body, func(t *testing.T) {
+			got, err := parseChart([]byte(tt.Body))
+			if err == nil {
+				err = got.validate()
+			}
+			if tt.WantErr != "" {
+				if err == nil || err.Error() != tt.WantErr {
+					t.Fatalf("got %v err, want %s", err, tt.WantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got %v err", err)
+			}
+			if !reflect.DeepEqual(got, tt.Want) {
+				t.Fatalf("got %+v, want %+v", got, tt.Want)
 			}
 		})
 	}
 }
+
+func TestNiceScale(t *testing.T) {
+	tests := []struct {
+		Low, High                   float64
+		WantLow, WantHigh, WantStep float64
+	}{
+		{Low: 0, High: 420, WantLow: 0, WantHigh: 500, WantStep: 100},
+		{Low: -3, High: 7, WantLow: -4, WantHigh: 8, WantStep: 2},
+		{Low: 0, High: 0.9, WantLow: 0, WantHigh: 1, WantStep: 0.2},
+		{Low: 0, High: 0, WantLow: 0, WantHigh: 1, WantStep: 0.2},
+	}
+
+	for _, tt := range tests {
+		low, high, step := niceScale(tt.Low, tt.High)
+		if low != tt.WantLow || high != tt.WantHigh || step != tt.WantStep {
+			t.Fatalf("got %v, %v, %v for [%v, %v], want %v, %v, %v", low, high, step, tt.Low, tt.High, tt.WantLow, tt.WantHigh, tt.WantStep)
+		}
+	}
+}
+
+// writeFiles writes files, keyed by slash-separated paths relative to
+// dir, creating the directories they are in.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// includeConverter returns a function making converters that can include
+// other files, with the extensions given by extensions added first.
+func includeConverter(extensions func(inputFile string) []goldmark.Extender) func(inputFile string) goldmark.Markdown {
+	var newConverter func(inputFile string) goldmark.Markdown
+	newConverter = func(inputFile string) goldmark.Markdown {
+		return NewPapermark(append(extensions(inputFile), &IncludeExtension{InputFile: inputFile, NewConverter: newConverter})...)
+	}
+	return newConverter
+}
+
+// testConvert converts markdown as inputFile with md and compares the
+// errors found while parsing with wantErr or, without errors, the output
+// after the template with wantTypst. It returns the parser context.
+func testConvert(t *testing.T, md goldmark.Markdown, inputFile, markdown, wantTypst, wantErr string) parser.Context {
+	t.Helper()
+	pc := parser.NewContext()
+	pc.Set(inputFileKey, inputFile)
+	doc := md.Parser().Parse(text.NewReader([]byte(markdown)), parser.WithContext(pc))
+	if err := parseErrors(pc); err != nil || wantErr != "" {
+		if err == nil || err.Error() != wantErr {
+			t.Fatalf("got %v err, want %s", err, wantErr)
+		}
+		return pc
+	}
+	b := new(strings.Builder)
+	if err := md.Renderer().Render(b, []byte(markdown), doc); err != nil {
+		t.Fatalf("got %v err", err)
+	}
+	if got := strings.TrimPrefix(b.String(), string(templateBytes)+"\n"); got != wantTypst {
+		t.Fatalf("got %q, want %q", got, wantTypst)
+	}
+	return pc
+}
@@ -1,9 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/yuin/goldmark"
 	"github.com/yuin/goldmark/ast"
 	"github.com/yuin/goldmark/parser"
 	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+	"gopkg.in/yaml.v3"
 )
 
 var KindImageBlock = ast.NewNodeKind("ImageBlock")
@@ -36,10 +56,8 @@ func (b *ImageBlockASTTransformer) Transform(doc *ast.Document, reader text.Read
 	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
 		if entering {
 			if n.Kind() == ast.KindParagraph {
-				if n.ChildCount() == 1 {
-					if n.FirstChild().Kind() == ast.KindImage {
-						imageBlockParagraphs = append(imageBlockParagraphs, n.(*ast.Paragraph))
-					}
+				if isImageParagraph(n, reader.Source()) {
+					imageBlockParagraphs = append(imageBlockParagraphs, n.(*ast.Paragraph))
 				}
 			}
 		}
@@ -48,9 +66,2329 @@ func (b *ImageBlockASTTransformer) Transform(doc *ast.Document, reader text.Read
 
 	for _, n := range imageBlockParagraphs {
 		imageBlock := NewImageBlock()
-		for c := n.FirstChild(); c != nil; c = c.NextSibling() {
-			imageBlock.AppendChild(imageBlock, c)
+		imageBlock.SetLines(n.Lines())
+		for _, a := range n.Attributes() {
+			imageBlock.SetAttribute(a.Name, a.Value)
+		}
+
+		for c := n.FirstChild(); c != nil; c = n.FirstChild() {
+			if c.Kind() == ast.KindImage {
+				imageBlock.AppendChild(imageBlock, c)
+			} else {
+				n.RemoveChild(n, c)
+			}
+		}
+
+		// Attributes of a standalone image apply to the whole block,
+		// and its title serves as a caption unless one is given.
+		// Images of a group keep theirs for their sub-figures.
+		if imageBlock.ChildCount() == 1 {
+			image := imageBlock.FirstChild().(*ast.Image)
+			setAttributes(imageBlock, image.Attributes())
+			if _, ok := imageBlock.AttributeString("caption"); !ok && len(image.Title) > 0 {
+				imageBlock.SetAttributeString("caption", image.Title)
+			}
 		}
+
 		n.Parent().ReplaceChild(n.Parent(), n, imageBlock)
 	}
 }
+
+// SVGBlockASTTransformer replaces fenced code blocks in the svg language
+// with image blocks showing the SVG, embedded as a data URI.
+type SVGBlockASTTransformer struct{}
+
+func NewSVGBlockASTTransformer() *SVGBlockASTTransformer {
+	return &SVGBlockASTTransformer{}
+}
+
+func (t *SVGBlockASTTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	svgBlocks := make([]*ast.FencedCodeBlock, 0)
+
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering {
+			if n.Kind() == ast.KindFencedCodeBlock {
+				n := n.(*ast.FencedCodeBlock)
+				if string(n.Language(reader.Source())) == "svg" {
+					svgBlocks = append(svgBlocks, n)
+				}
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for _, n := range svgBlocks {
+		svg := n.Lines().Value(reader.Source())
+		replaceWithImageBlock(n, []byte("data:image/svg+xml;base64,"+base64.StdEncoding.EncodeToString(svg)))
+	}
+}
+
+// DiagramASTTransformer replaces fenced code blocks in the languages of
+// Diagrams with image blocks showing the rendered diagrams. Blocks whose
+// tool isn't installed are left as listings with a warning.
+type DiagramASTTransformer struct {
+	InputFile string
+	Diagrams  *Diagrams
+}
+
+func NewDiagramASTTransformer(inputFile string, diagrams *Diagrams) *DiagramASTTransformer {
+	return &DiagramASTTransformer{InputFile: inputFile, Diagrams: diagrams}
+}
+
+func (t *DiagramASTTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	diagramBlocks := make([]*ast.FencedCodeBlock, 0)
+
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering {
+			if n.Kind() == ast.KindFencedCodeBlock {
+				n := n.(*ast.FencedCodeBlock)
+				if _, ok := t.Diagrams.Commands[string(n.Language(source))]; ok {
+					diagramBlocks = append(diagramBlocks, n)
+				}
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for _, n := range diagramBlocks {
+		lang := string(n.Language(source))
+		path, err := t.Diagrams.Render(lang, n.Lines().Value(source))
+		if errors.Is(err, errToolMissing) {
+			slog.Warn("diagram shown as listing", "pos", fmt.Sprintf("%s:%d", t.InputFile, lineNumber(n, source)), "lang", lang, "err", err)
+			continue
+		}
+		if err != nil {
+			addError(pc, fmt.Errorf("%s:%d: %s diagram: %w", t.InputFile, lineNumber(n, source), lang, err))
+			continue
+		}
+		replaceWithImageBlock(n, []byte(path))
+	}
+}
+
+// replaceWithImageBlock replaces block n with an image block showing the
+// image at destination. The image block takes over the attributes of n.
+func replaceWithImageBlock(n ast.Node, destination []byte) {
+	link := ast.NewLink()
+	link.Destination = destination
+	image := ast.NewImage(link)
+
+	imageBlock := NewImageBlock()
+	imageBlock.SetLines(n.Lines())
+	for _, a := range n.Attributes() {
+		imageBlock.SetAttribute(a.Name, a.Value)
+	}
+	imageBlock.AppendChild(imageBlock, image)
+	n.Parent().ReplaceChild(n.Parent(), n, imageBlock)
+}
+
+// isImageParagraph reports whether paragraph n consists of one or more
+// images separated only by whitespace.
+func isImageParagraph(n ast.Node, source []byte) bool {
+	images := 0
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		switch c := c.(type) {
+		case *ast.Image:
+			images++
+		case *ast.Text:
+			if len(bytes.TrimSpace(c.Value(source))) != 0 || c.HardLineBreak() {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return images > 0
+}
+
+var KindChartBlock = ast.NewNodeKind("ChartBlock")
+
+// ChartBlock is a chart drawn from the data of a chart fence.
+type ChartBlock struct {
+	ast.BaseBlock
+	Chart *Chart
+}
+
+func NewChartBlock(chart *Chart) *ChartBlock {
+	return &ChartBlock{Chart: chart}
+}
+
+func (n *ChartBlock) Kind() ast.NodeKind {
+	return KindChartBlock
+}
+
+func (n *ChartBlock) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Type": n.Chart.Type}, nil)
+}
+
+// ChartBlockASTTransformer replaces fenced code blocks in the chart
+// language with chart blocks. A type attribute on the fence sets the
+// chart type unless the data does.
+type ChartBlockASTTransformer struct{}
+
+func NewChartBlockASTTransformer() *ChartBlockASTTransformer {
+	return &ChartBlockASTTransformer{}
+}
+
+func (t *ChartBlockASTTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	chartFences := make([]*ast.FencedCodeBlock, 0)
+
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering {
+			if n.Kind() == ast.KindFencedCodeBlock {
+				n := n.(*ast.FencedCodeBlock)
+				if string(n.Language(source)) == "chart" {
+					chartFences = append(chartFences, n)
+				}
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for _, n := range chartFences {
+		chart, err := parseChart(n.Lines().Value(source))
+		if err == nil {
+			if v, ok := attributeString(n, "type"); ok && chart.Type == "" {
+				chart.Type = v
+			}
+			err = chart.validate()
+		}
+		if err != nil {
+			addError(pc, fmt.Errorf("%s: chart: %w", position(pc, n, source), err))
+			continue
+		}
+
+		chartBlock := NewChartBlock(chart)
+		chartBlock.SetLines(n.Lines())
+		for _, a := range n.Attributes() {
+			chartBlock.SetAttribute(a.Name, a.Value)
+		}
+		n.Parent().ReplaceChild(n.Parent(), n, chartBlock)
+	}
+}
+
+var KindListingBlock = ast.NewNodeKind("ListingBlock")
+
+// ListingBlock is a code listing whose code doesn't come from the
+// document, such as one included from a file.
+type ListingBlock struct {
+	ast.BaseBlock
+	Language string
+	Code     []byte
+}
+
+func NewListingBlock(language string, code []byte) *ListingBlock {
+	return &ListingBlock{Language: language, Code: code}
+}
+
+func (n *ListingBlock) Kind() ast.NodeKind {
+	return KindListingBlock
+}
+
+func (n *ListingBlock) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Language": n.Language}, nil)
+}
+
+// ListingIncludeASTTransformer replaces fenced code blocks with a file
+// attribute with listing blocks of the file, read relative to the
+// directory of the input file. The lines and region attributes select a
+// part of the file as described in [ReadListing]. The language defaults
+// to the one of the file extension, and the body of the fence is ignored.
+// Numbered listings of a line range start at the number of its first line.
+type ListingIncludeASTTransformer struct {
+	InputFile string
+}
+
+func NewListingIncludeASTTransformer(inputFile string) *ListingIncludeASTTransformer {
+	return &ListingIncludeASTTransformer{InputFile: inputFile}
+}
+
+func (t *ListingIncludeASTTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	includeFences := make([]*ast.FencedCodeBlock, 0)
+
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering {
+			if n.Kind() == ast.KindFencedCodeBlock {
+				if _, ok := attributeString(n, "file"); ok {
+					includeFences = append(includeFences, n.(*ast.FencedCodeBlock))
+				}
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+
+	dir := filepath.Dir(t.InputFile)
+	for _, n := range includeFences {
+		file, _ := attributeString(n, "file")
+		lines, _ := attributeString(n, "lines")
+		region, _ := attributeString(n, "region")
+		code, err := ReadListing(filepath.Join(dir, filepath.FromSlash(file)), lines, region)
+		if err != nil {
+			if pathErr := (*fs.PathError)(nil); errors.As(err, &pathErr) {
+				err = pathErr.Err
+			}
+			addError(pc, fmt.Errorf("%s:%d: listing %s: %w", t.InputFile, lineNumber(n, source), file, err))
+			continue
+		}
+
+		lang := string(fenceLanguage(n, source))
+		if lang == "" {
+			lang = listingLanguage(file)
+		}
+		listingBlock := NewListingBlock(lang, code)
+		listingBlock.SetLines(n.Lines())
+		for _, a := range n.Attributes() {
+			listingBlock.SetAttribute(a.Name, a.Value)
+		}
+		if _, ok := attributeString(n, "start"); !ok && hasClass(n, "numbered") {
+			if from, _, _ := strings.Cut(lines, "-"); from != "" && !strings.Contains(lines, ",") {
+				listingBlock.SetAttribute([]byte("start"), []byte(from))
+			}
+		}
+		n.Parent().ReplaceChild(n.Parent(), n, listingBlock)
+	}
+}
+
+// listingCode returns the language and code of a listing node, which is
+// either a fenced code block or a listing block.
+func listingCode(n ast.Node, source []byte) (lang []byte, code []byte, ok bool) {
+	switch n := n.(type) {
+	case *ast.FencedCodeBlock:
+		return fenceLanguage(n, source), n.Lines().Value(source), true
+	case *ListingBlock:
+		return []byte(n.Language), n.Code, true
+	default:
+		return nil, nil, false
+	}
+}
+
+// ExecASTTransformer runs the code of listings with the exec class with
+// Executor and adds a listing of the output after them. The exit
+// attribute sets the expected exit code, 0 by default. Listings whose
+// command isn't installed are left without output with a warning.
+type ExecASTTransformer struct {
+	InputFile string
+	Executor  *Executor
+}
+
+func NewExecASTTransformer(inputFile string, executor *Executor) *ExecASTTransformer {
+	return &ExecASTTransformer{InputFile: inputFile, Executor: executor}
+}
+
+func (t *ExecASTTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	execListings := make([]ast.Node, 0)
+
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering {
+			if _, _, ok := listingCode(n, source); ok && hasClass(n, "exec") {
+				execListings = append(execListings, n)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for _, n := range execListings {
+		lang, code, _ := listingCode(n, source)
+		exit := 0
+		if v, ok := attributeString(n, "exit"); ok {
+			var err error
+			exit, err = strconv.Atoi(v)
+			if err != nil {
+				addError(pc, fmt.Errorf("%s:%d: exec: invalid exit code %q", t.InputFile, lineNumber(n, source), v))
+				continue
+			}
+		}
+		output, err := t.Executor.Run(string(lang), code, exit)
+		if errors.Is(err, errToolMissing) {
+			slog.Warn("code shown without output", "pos", fmt.Sprintf("%s:%d", t.InputFile, lineNumber(n, source)), "lang", string(lang), "err", err)
+			continue
+		}
+		if err != nil {
+			addError(pc, fmt.Errorf("%s:%d: exec: %w", t.InputFile, lineNumber(n, source), err))
+			continue
+		}
+
+		outputBlock := NewListingBlock("", output)
+		outputBlock.SetLines(n.Lines())
+		n.Parent().InsertAfter(n.Parent(), n, outputBlock)
+	}
+}
+
+// fenceLanguage returns the language of fenced code block n, or nil if
+// its info string has none and consists of an attribute list only.
+func fenceLanguage(n *ast.FencedCodeBlock, source []byte) []byte {
+	lang := n.Language(source)
+	if bytes.HasPrefix(lang, []byte("{")) {
+		return nil
+	}
+	return lang
+}
+
+var KindRawStyle = ast.NewNodeKind("RawStyle")
+
+// RawStyle sets the syntax highlighting theme and the additional syntax
+// definitions of raw text for the rest of the document.
+type RawStyle struct {
+	ast.BaseBlock
+	Theme    string
+	Syntaxes []string
+}
+
+func NewRawStyle(theme string, syntaxes []string) *RawStyle {
+	return &RawStyle{Theme: theme, Syntaxes: syntaxes}
+}
+
+func (n *RawStyle) Kind() ast.NodeKind {
+	return KindRawStyle
+}
+
+func (n *RawStyle) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Theme": n.Theme, "Syntaxes": strings.Join(n.Syntaxes, ", ")}, nil)
+}
+
+// RawStyleASTTransformer starts the document with a raw style of Theme
+// and Syntaxes, which are paths to .tmTheme and .sublime-syntax files.
+type RawStyleASTTransformer struct {
+	Theme    string
+	Syntaxes []string
+}
+
+func NewRawStyleASTTransformer(theme string, syntaxes []string) *RawStyleASTTransformer {
+	return &RawStyleASTTransformer{Theme: theme, Syntaxes: syntaxes}
+}
+
+func (t *RawStyleASTTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	if t.Theme == "" && len(t.Syntaxes) == 0 {
+		return
+	}
+	rawStyle := NewRawStyle(t.Theme, slices.Clone(t.Syntaxes))
+	if doc.FirstChild() != nil {
+		doc.InsertBefore(doc, doc.FirstChild(), rawStyle)
+	} else {
+		doc.AppendChild(doc, rawStyle)
+	}
+}
+
+var KindFrontMatter = ast.NewNodeKind("FrontMatter")
+
+// FrontMatter holds the lines of the front matter until
+// FrontMatterASTTransformer decodes and removes it.
+type FrontMatter struct {
+	ast.BaseBlock
+}
+
+func NewFrontMatter() *FrontMatter {
+	return &FrontMatter{}
+}
+
+func (n *FrontMatter) Kind() ast.NodeKind {
+	return KindFrontMatter
+}
+
+func (n *FrontMatter) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, nil, nil)
+}
+
+// FrontMatterParser is based on [github.com/yuin/goldmark-meta].
+type FrontMatterParser struct{}
+
+func NewFrontMatterParser() *FrontMatterParser {
+	return &FrontMatterParser{}
+}
+
+func isFrontMatterSeparator(line []byte) bool {
+	return string(util.TrimRightSpace(line)) == "---"
+}
+
+func (b *FrontMatterParser) Trigger() []byte {
+	return []byte{'-'}
+}
+
+func (b *FrontMatterParser) Open(parent ast.Node, reader text.Reader, pc parser.Context) (ast.Node, parser.State) {
+	lineNum, _ := reader.Position()
+	if lineNum != 0 {
+		return nil, parser.NoChildren
+	}
+	line, _ := reader.PeekLine()
+	if isFrontMatterSeparator(line) {
+		return NewFrontMatter(), parser.NoChildren
+	}
+	return nil, parser.NoChildren
+}
+
+func (b *FrontMatterParser) Continue(node ast.Node, reader text.Reader, pc parser.Context) parser.State {
+	line, segment := reader.PeekLine()
+	if isFrontMatterSeparator(line) || string(util.TrimRightSpace(line)) == "..." {
+		reader.Advance(segment.Len())
+		return parser.Close
+	}
+	node.Lines().Append(segment)
+	return parser.Continue | parser.NoChildren
+}
+
+func (b *FrontMatterParser) Close(node ast.Node, reader text.Reader, pc parser.Context) {}
+
+func (b *FrontMatterParser) CanInterruptParagraph() bool {
+	return false
+}
+
+func (b *FrontMatterParser) CanAcceptIndentedLine() bool {
+	return false
+}
+
+// FrontMatterASTTransformer decodes the front matter into the Metadata
+// returned by documentMetadata and removes it from the document.
+type FrontMatterASTTransformer struct{}
+
+func NewFrontMatterASTTransformer() *FrontMatterASTTransformer {
+	return &FrontMatterASTTransformer{}
+}
+
+func (t *FrontMatterASTTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	n, ok := doc.FirstChild().(*FrontMatter)
+	if !ok {
+		return
+	}
+	doc.RemoveChild(doc, n)
+
+	m := &Metadata{}
+	body := n.Lines().Value(reader.Source())
+	if len(bytes.TrimSpace(body)) != 0 {
+		err := yaml.Unmarshal(body, m)
+		if err != nil {
+			addError(pc, fmt.Errorf("%s: front matter: %w", position(pc, n, reader.Source()), err))
+			return
+		}
+	}
+	if m.Lang != "" && !langPattern.MatchString(m.Lang) {
+		addError(pc, fmt.Errorf("%s: front matter: invalid lang %q", position(pc, n, reader.Source()), m.Lang))
+		return
+	}
+	pc.Set(metadataKey, m)
+}
+
+// langPattern matches the ISO 639 language codes Typst accepts.
+var langPattern = regexp.MustCompile(`^[a-z]{2,3}$`)
+
+// InlineCodeASTTransformer sets the lang attribute of inline code to its
+// first class, as in `fmt.Println()`{.go}, or to the inline code language
+// of the document metadata.
+type InlineCodeASTTransformer struct{}
+
+func NewInlineCodeASTTransformer() *InlineCodeASTTransformer {
+	return &InlineCodeASTTransformer{}
+}
+
+func (t *InlineCodeASTTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	defaultLang := documentMetadata(pc).InlineCodeLanguage
+
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering {
+			if n.Kind() == ast.KindCodeSpan {
+				if _, ok := attributeString(n, "lang"); ok {
+					return ast.WalkSkipChildren, nil
+				}
+				lang := defaultLang
+				if class, ok := attributeString(n, "class"); ok && class != "" {
+					lang = strings.Fields(class)[0]
+				}
+				if lang != "" {
+					n.SetAttribute([]byte("lang"), []byte(lang))
+				}
+				return ast.WalkSkipChildren, nil
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+}
+
+var KindOutline = ast.NewNodeKind("Outline")
+
+// Outline is a table of contents, a list of figures or a list of tables,
+// as OutlineKind toc, lof or lot says. Depth limits the heading levels of a
+// table of contents if it isn't 0.
+type Outline struct {
+	ast.BaseBlock
+	OutlineKind string
+	Depth       int
+}
+
+func NewOutline(kind string, depth int) *Outline {
+	return &Outline{OutlineKind: kind, Depth: depth}
+}
+
+func (n *Outline) Kind() ast.NodeKind {
+	return KindOutline
+}
+
+func (n *Outline) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"OutlineKind": n.OutlineKind, "Depth": strconv.Itoa(n.Depth)}, nil)
+}
+
+// outlinePattern matches an outline directive such as [[toc]], optionally
+// followed by an attribute list.
+var outlinePattern = regexp.MustCompile(`^\[\[(toc|lof|lot)\]\][ \t]*(\{.*\})?$`)
+
+// OutlineASTTransformer replaces paragraphs of a single [[toc]], [[lof]]
+// or [[lot]] directive with outlines. A depth attribute as in
+// [[toc]]{depth=2} limits the heading levels of a table of contents.
+// The toc, lof and lot switches of the document metadata put the
+// outlines that have no directive at the start of the document.
+type OutlineASTTransformer struct{}
+
+func NewOutlineASTTransformer() *OutlineASTTransformer {
+	return &OutlineASTTransformer{}
+}
+
+func (t *OutlineASTTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	found := make(map[string]bool)
+	directives := make([]*ast.Paragraph, 0)
+
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering {
+			if n.Kind() == ast.KindParagraph && isOutlineParagraph(n, source) {
+				directives = append(directives, n.(*ast.Paragraph))
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+
+	inputFile, _ := pc.Get(inputFileKey).(string)
+	for _, n := range directives {
+		for i := 0; i < n.Lines().Len(); i++ {
+			l := n.Lines().At(i)
+			// The directives are on consecutive lines of the paragraph.
+			pos := fmt.Sprintf("%s:%d", inputFile, lineNumber(n, source)+i)
+			m := outlinePattern.FindSubmatch(bytes.TrimSpace(l.Value(source)))
+			kind := string(m[1])
+			depth, err := outlineDepth(n, m[2])
+			if err != nil {
+				addError(pc, fmt.Errorf("%s: %s: %w", pos, kind, err))
+				continue
+			}
+			found[kind] = true
+			n.Parent().InsertBefore(n.Parent(), n, NewOutline(kind, depth))
+		}
+		n.Parent().RemoveChild(n.Parent(), n)
+	}
+
+	m := documentMetadata(pc)
+	outlines := []struct {
+		Kind string
+		On   bool
+	}{{"toc", m.TOC}, {"lof", m.LOF}, {"lot", m.LOT}}
+	var last ast.Node
+	for _, o := range outlines {
+		if !o.On || found[o.Kind] {
+			continue
+		}
+		depth := 0
+		if o.Kind == "toc" {
+			depth = m.TOCDepth
+		}
+		outline := NewOutline(o.Kind, depth)
+		if last == nil && doc.FirstChild() == nil {
+			doc.AppendChild(doc, outline)
+		} else if last == nil {
+			doc.InsertBefore(doc, doc.FirstChild(), outline)
+		} else {
+			doc.InsertAfter(doc, last, outline)
+		}
+		last = outline
+	}
+}
+
+// outlineDepth returns the depth set by the attribute list of an outline
+// directive, which may be empty, or by the attributes of its paragraph n.
+func outlineDepth(n ast.Node, p []byte) (int, error) {
+	v, ok := attributeString(n, "depth")
+	if p != nil {
+		attrs, _, err := parseAttributes(p)
+		if err != nil {
+			return 0, fmt.Errorf("attributes %s: %w", p, err)
+		}
+		for _, a := range attrs {
+			if string(a.Name) == "depth" {
+				v, ok = string(a.Value.([]byte)), true
+			}
+		}
+	}
+	if !ok {
+		return 0, nil
+	}
+	depth, err := strconv.Atoi(v)
+	if err != nil || depth < 1 {
+		return 0, fmt.Errorf("invalid depth %q", v)
+	}
+	return depth, nil
+}
+
+// isOutlineParagraph reports whether every line of paragraph n is an
+// outline directive.
+func isOutlineParagraph(n ast.Node, source []byte) bool {
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		l := lines.At(i)
+		if !outlinePattern.Match(bytes.TrimSpace(l.Value(source))) {
+			return false
+		}
+	}
+	return lines.Len() > 0
+}
+
+var KindLanguage = ast.NewNodeKind("Language")
+
+// Language sets the language of the text after it.
+type Language struct {
+	ast.BaseBlock
+	Lang string
+}
+
+func NewLanguage(lang string) *Language {
+	return &Language{Lang: lang}
+}
+
+func (n *Language) Kind() ast.NodeKind {
+	return KindLanguage
+}
+
+func (n *Language) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Lang": n.Lang}, nil)
+}
+
+// LanguageASTTransformer puts a Language at the start of the document if
+// its metadata sets one.
+type LanguageASTTransformer struct{}
+
+func NewLanguageASTTransformer() *LanguageASTTransformer {
+	return &LanguageASTTransformer{}
+}
+
+func (t *LanguageASTTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	lang := documentMetadata(pc).Lang
+	if lang == "" {
+		return
+	}
+	if doc.FirstChild() != nil {
+		doc.InsertBefore(doc, doc.FirstChild(), NewLanguage(lang))
+	} else {
+		doc.AppendChild(doc, NewLanguage(lang))
+	}
+}
+
+var KindChapterNumbering = ast.NewNodeKind("ChapterNumbering")
+
+// ChapterNumbering numbers the figures, tables, listings and equations
+// after it within chapters, which are level 1 headings.
+type ChapterNumbering struct {
+	ast.BaseBlock
+}
+
+func NewChapterNumbering() *ChapterNumbering {
+	return &ChapterNumbering{}
+}
+
+func (n *ChapterNumbering) Kind() ast.NodeKind {
+	return KindChapterNumbering
+}
+
+func (n *ChapterNumbering) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, nil, nil)
+}
+
+// ChapterNumberingASTTransformer puts a ChapterNumbering at the start of
+// the document if its metadata asks for chapter numbering.
+type ChapterNumberingASTTransformer struct{}
+
+func NewChapterNumberingASTTransformer() *ChapterNumberingASTTransformer {
+	return &ChapterNumberingASTTransformer{}
+}
+
+func (t *ChapterNumberingASTTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	if !documentMetadata(pc).ChapterNumbering {
+		return
+	}
+	if doc.FirstChild() != nil {
+		doc.InsertBefore(doc, doc.FirstChild(), NewChapterNumbering())
+	} else {
+		doc.AppendChild(doc, NewChapterNumbering())
+	}
+}
+
+var KindTransclusion = ast.NewNodeKind("Transclusion")
+
+// Transclusion holds the blocks of an included Markdown file, which refer
+// to Source rather than to the source of the including document.
+type Transclusion struct {
+	ast.BaseBlock
+	File   string
+	Source []byte
+}
+
+func NewTransclusion(file string, source []byte) *Transclusion {
+	return &Transclusion{File: file, Source: source}
+}
+
+func (n *Transclusion) Kind() ast.NodeKind {
+	return KindTransclusion
+}
+
+func (n *Transclusion) Dump(source []byte, level int) {
+	ast.DumpHelper(n, n.Source, level, map[string]string{"File": n.File}, nil)
+}
+
+// includePattern matches an include directive, either !include path.md
+// or ![[note]], optionally followed by an attribute list.
+var includePattern = regexp.MustCompile(`^(?:!include[ \t]+(\S+)|!\[\[([^\]|#]+)\]\])[ \t]*(\{.*\})?$`)
+
+var includeStackKey = parser.NewContextKey()
+
+// IncludeASTTransformer replaces paragraphs of include directives with
+// transclusions of the named Markdown files, read relative to the
+// directory of the input file. ![[note]] includes note.md. Included files
+// are parsed by converters from NewConverter, so they go through the same
+// pipeline with paths relative to themselves. A shift attribute as in
+// !include methods.md {shift=1} shifts their heading levels. The files
+// listed as appendices in the front matter are included at the end, after
+// the start of the appendices.
+//
+// The transformer runs after AssetASTTransformer and moves the asset
+// paths of the document and of the included files to a common root.
+type IncludeASTTransformer struct {
+	InputFile    string
+	NewConverter func(inputFile string) goldmark.Markdown
+}
+
+func NewIncludeASTTransformer(inputFile string, newConverter func(inputFile string) goldmark.Markdown) *IncludeASTTransformer {
+	return &IncludeASTTransformer{InputFile: inputFile, NewConverter: newConverter}
+}
+
+func (t *IncludeASTTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	includeParagraphs := make([]*ast.Paragraph, 0)
+
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering {
+			if n.Kind() == ast.KindParagraph && isIncludeParagraph(n, source) {
+				includeParagraphs = append(includeParagraphs, n.(*ast.Paragraph))
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+	for _, n := range includeParagraphs {
+		for i := 0; i < n.Lines().Len(); i++ {
+			l := n.Lines().At(i)
+			// The directives are on consecutive lines of the paragraph.
+			pos := fmt.Sprintf("%s:%d", t.InputFile, lineNumber(n, source)+i)
+			m := includePattern.FindSubmatch(bytes.TrimSpace(l.Value(source)))
+			name := string(m[1])
+			if m[2] != nil {
+				name = strings.TrimSpace(string(m[2])) + ".md"
+			}
+			shift, err := includeShift(m[3])
+			if err != nil {
+				addError(pc, fmt.Errorf("%s: include %s: %w", pos, name, err))
+				continue
+			}
+
+			file := filepath.Join(filepath.Dir(t.InputFile), filepath.FromSlash(name))
+			transclusion, err := transclude(doc, pc, file, shift, t.NewConverter)
+			if err != nil {
+				addError(pc, fmt.Errorf("%s: include %s: %w", pos, name, err))
+				continue
+			}
+			if transclusion != nil {
+				n.Parent().InsertBefore(n.Parent(), n, transclusion)
+			}
+		}
+		n.Parent().RemoveChild(n.Parent(), n)
+	}
+
+	appendices := documentMetadata(pc).Appendices
+	if len(appendices) != 0 && !hasAppendices(doc) {
+		doc.AppendChild(doc, NewPart("", true))
+	}
+	for _, name := range appendices {
+		file := filepath.Join(filepath.Dir(t.InputFile), filepath.FromSlash(name))
+		transclusion, err := transclude(doc, pc, file, 0, t.NewConverter)
+		if err != nil {
+			addError(pc, fmt.Errorf("%s: appendix %s: %w", t.InputFile, name, err))
+			continue
+		}
+		if transclusion != nil {
+			doc.AppendChild(doc, transclusion)
+		}
+	}
+}
+
+// transclude parses the Markdown file at file with a converter from
+// newConverter and returns its blocks as a transclusion with heading
+// levels shifted by shift. The asset paths of doc and of the file are
+// moved to a common root, which is recorded in pc. Errors found in the
+// file are recorded in pc too, and the transclusion is nil then.
+func transclude(doc ast.Node, pc parser.Context, file string, shift int, newConverter func(inputFile string) goldmark.Markdown) (*Transclusion, error) {
+	stack, _ := pc.Get(includeStackKey).([]string)
+	if len(stack) == 0 {
+		inputFile, _ := pc.Get(inputFileKey).(string)
+		stack = []string{inputFile}
+	}
+	if slices.Contains(stack, file) {
+		return nil, fmt.Errorf("cycle %s", strings.Join(append(stack, file), " -> "))
+	}
+	source, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Unwrap(err)
+	}
+
+	includePC := parser.NewContext()
+	includePC.Set(inputFileKey, file)
+	includePC.Set(includeStackKey, append(slices.Clone(stack), file))
+	includeDoc := newConverter(file).Parser().Parse(text.NewReader(source), parser.WithContext(includePC))
+	if err := parseErrors(includePC); err != nil {
+		addError(pc, err)
+		return nil, nil
+	}
+
+	root, includeRoot := assetRoot(pc), assetRoot(includePC)
+	if root != "" && includeRoot != "" {
+		common, err := commonRoot(root, includeRoot)
+		if err != nil {
+			return nil, err
+		}
+		rebaseAssets(doc, root, common)
+		rebaseAssets(includeDoc, includeRoot, common)
+		pc.Set(assetRootKey, common)
+	}
+
+	transclusion := NewTransclusion(file, source)
+	for c := includeDoc.FirstChild(); c != nil; c = includeDoc.FirstChild() {
+		transclusion.AppendChild(transclusion, c)
+	}
+	if shift != 0 {
+		_ = ast.Walk(transclusion, func(c ast.Node, entering bool) (ast.WalkStatus, error) {
+			if h, ok := c.(*ast.Heading); ok && entering {
+				h.Level = min(max(h.Level+shift, 1), 6)
+			}
+			return ast.WalkContinue, nil
+		})
+	}
+	return transclusion, nil
+}
+
+// walkFiles walks doc, which is the document of file with source, and the
+// transclusions in it like ast.Walk, calling fn on entering every node but
+// the transclusions with the file and source the node comes from.
+func walkFiles(doc ast.Node, file string, source []byte, fn func(n ast.Node, file string, source []byte) ast.WalkStatus) {
+	stack := []*Transclusion{NewTransclusion(file, source)}
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if n, ok := n.(*Transclusion); ok {
+			if entering {
+				stack = append(stack, n)
+			} else {
+				stack = stack[:len(stack)-1]
+			}
+			return ast.WalkContinue, nil
+		}
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		top := stack[len(stack)-1]
+		return fn(n, top.File, top.Source), nil
+	})
+}
+
+// includeShift returns the heading shift of the attribute list of an
+// include directive, which may be empty.
+func includeShift(p []byte) (int, error) {
+	if p == nil {
+		return 0, nil
+	}
+	attrs, _, err := parseAttributes(p)
+	if err != nil {
+		return 0, fmt.Errorf("attributes %s: %w", p, err)
+	}
+	shift := 0
+	for _, a := range attrs {
+		if string(a.Name) == "shift" {
+			var err error
+			shift, err = strconv.Atoi(string(a.Value.([]byte)))
+			if err != nil {
+				return 0, fmt.Errorf("invalid shift %q", a.Value)
+			}
+		}
+	}
+	return shift, nil
+}
+
+// isIncludeParagraph reports whether every line of paragraph n is an
+// include directive.
+func isIncludeParagraph(n ast.Node, source []byte) bool {
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		l := lines.At(i)
+		if !includePattern.Match(bytes.TrimSpace(l.Value(source))) {
+			return false
+		}
+	}
+	return lines.Len() > 0
+}
+
+// rebaseAssets rewrites the asset paths in n that are absolute within
+// oldRoot, as AssetASTTransformer leaves them, to be absolute within
+// newRoot, which contains oldRoot.
+func rebaseAssets(n ast.Node, oldRoot, newRoot string) {
+	prefix, err := filepath.Rel(newRoot, oldRoot)
+	if err != nil || prefix == "." {
+		return
+	}
+	prefix = "/" + filepath.ToSlash(prefix)
+
+	_ = ast.Walk(n, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering {
+			switch n := n.(type) {
+			case *ast.Image:
+				if bytes.HasPrefix(n.Destination, []byte("/")) {
+					n.Destination = append([]byte(prefix), n.Destination...)
+				}
+			case *RawStyle:
+				if n.Theme != "" {
+					n.Theme = prefix + n.Theme
+				}
+				for i := range n.Syntaxes {
+					n.Syntaxes[i] = prefix + n.Syntaxes[i]
+				}
+			case *Bibliography:
+				for i := range n.Files {
+					n.Files[i] = prefix + n.Files[i]
+				}
+				if strings.HasPrefix(n.Style, "/") {
+					n.Style = prefix + n.Style
+				}
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+}
+
+var KindPart = ast.NewNodeKind("Part")
+
+// Part starts a part of a book, or the appendices if Appendices is set.
+type Part struct {
+	ast.BaseBlock
+	Title      string
+	Appendices bool
+}
+
+func NewPart(title string, appendices bool) *Part {
+	return &Part{Title: title, Appendices: appendices}
+}
+
+func (n *Part) Kind() ast.NodeKind {
+	return KindPart
+}
+
+func (n *Part) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Title": n.Title, "Appendices": strconv.FormatBool(n.Appendices)}, nil)
+}
+
+// AppendixASTTransformer starts the appendices at an [[appendix]]
+// directive or at a heading with the appendix class, whichever comes
+// first, with a Part. Later markers are dropped.
+type AppendixASTTransformer struct{}
+
+func NewAppendixASTTransformer() *AppendixASTTransformer {
+	return &AppendixASTTransformer{}
+}
+
+func (t *AppendixASTTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	started := false
+	for n := doc.FirstChild(); n != nil; {
+		next := n.NextSibling()
+		switch {
+		case n.Kind() == ast.KindParagraph && bytes.Equal(bytes.TrimSpace(n.Lines().Value(source)), []byte("[[appendix]]")):
+			if started {
+				doc.RemoveChild(doc, n)
+			} else {
+				doc.ReplaceChild(doc, n, NewPart("", true))
+			}
+			started = true
+		case n.Kind() == ast.KindHeading && hasClass(n, "appendix"):
+			if !started {
+				doc.InsertBefore(doc, n, NewPart("", true))
+			}
+			started = true
+		case n.Kind() == KindPart && n.(*Part).Appendices:
+			started = true
+		}
+		n = next
+	}
+}
+
+// hasAppendices reports whether a Part in doc starts the appendices.
+func hasAppendices(doc ast.Node) bool {
+	for n := doc.FirstChild(); n != nil; n = n.NextSibling() {
+		if p, ok := n.(*Part); ok && p.Appendices {
+			return true
+		}
+	}
+	return false
+}
+
+var KindPageBreak = ast.NewNodeKind("PageBreak")
+
+// PageBreak starts a new page unless the page is empty.
+type PageBreak struct {
+	ast.BaseBlock
+}
+
+func NewPageBreak() *PageBreak {
+	return &PageBreak{}
+}
+
+func (n *PageBreak) Kind() ast.NodeKind {
+	return KindPageBreak
+}
+
+func (n *PageBreak) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, nil, nil)
+}
+
+// BookASTTransformer appends the chapters of Book to the document, which
+// is the manifest at InputFile, as transclusions. Chapters are parsed by
+// converters from NewConverter and their headings are shifted by their
+// level in the manifest. Every top-level chapter but the first starts on a
+// new page, and parts and appendices are started with Part nodes.
+//
+// The chapters end up in one Typst document, so they share numbering and
+// labels. The transformer reports labels defined in more than one place.
+// It runs after IncludeASTTransformer, which would take the chapters for
+// blocks of the manifest.
+type BookASTTransformer struct {
+	InputFile    string
+	Book         *Book
+	NewConverter func(inputFile string) goldmark.Markdown
+}
+
+func NewBookASTTransformer(inputFile string, book *Book, newConverter func(inputFile string) goldmark.Markdown) *BookASTTransformer {
+	return &BookASTTransformer{InputFile: inputFile, Book: book, NewConverter: newConverter}
+}
+
+func (t *BookASTTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	first := true
+	for _, part := range t.Book.Parts {
+		if part.Title != "" || part.Appendices {
+			doc.AppendChild(doc, NewPart(part.Title, part.Appendices))
+		}
+		for _, chapter := range part.Chapters {
+			pos := t.InputFile
+			if chapter.Line != 0 {
+				pos = fmt.Sprintf("%s:%d", t.InputFile, chapter.Line)
+			}
+
+			file := filepath.Join(filepath.Dir(t.InputFile), filepath.FromSlash(chapter.File))
+			transclusion, err := transclude(doc, pc, file, chapter.Level, t.NewConverter)
+			if err != nil {
+				addError(pc, fmt.Errorf("%s: chapter %s: %w", pos, chapter.File, err))
+				continue
+			}
+			if transclusion == nil {
+				continue
+			}
+			if chapter.Level == 0 && !first {
+				doc.AppendChild(doc, NewPageBreak())
+			}
+			doc.AppendChild(doc, transclusion)
+			first = false
+		}
+	}
+
+	// Labels are the ids of blocks and images.
+	labels := make(map[string]string)
+	walkFiles(doc, t.InputFile, reader.Source(), func(n ast.Node, file string, source []byte) ast.WalkStatus {
+		id, ok := attributeString(n, "id")
+		if !ok {
+			return ast.WalkContinue
+		}
+		if parentID, _ := attributeString(n.Parent(), "id"); parentID == id {
+			return ast.WalkContinue // A standalone image shares the label of its block.
+		}
+		pos := fmt.Sprintf("%s:%d", file, lineNumber(n, source))
+		if other, ok := labels[id]; ok {
+			addError(pc, fmt.Errorf("%s: label %s already defined at %s", pos, id, other))
+		} else {
+			labels[id] = pos
+		}
+		return ast.WalkContinue
+	})
+}
+
+var KindCrossReference = ast.NewNodeKind("CrossReference")
+
+// CrossReference is a link to the heading labeled Label, with the text of
+// the link as its children.
+type CrossReference struct {
+	ast.BaseInline
+	Label string
+}
+
+func NewCrossReference(label string) *CrossReference {
+	return &CrossReference{Label: label}
+}
+
+func (n *CrossReference) Kind() ast.NodeKind {
+	return KindCrossReference
+}
+
+func (n *CrossReference) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Label": n.Label}, nil)
+}
+
+var errNotInBuild = errors.New("file not in the build")
+
+// CrossReferenceASTTransformer replaces links to headings of Markdown
+// files, as in [see setup](setup.md#installation), with cross-references
+// when the files are in the build: the input file and the files it
+// includes or, for a book, its chapters. Headings are found by their id
+// attribute or by the anchor GitHub gives them, and a link without an
+// anchor refers to the first heading of the file. The headings referred
+// to get labels, which are their ids or are made from their anchors.
+//
+// Links to other Markdown files would be dead in the output, so they are
+// shown as their text with a warning.
+type CrossReferenceASTTransformer struct {
+	InputFile string
+}
+
+func NewCrossReferenceASTTransformer(inputFile string) *CrossReferenceASTTransformer {
+	return &CrossReferenceASTTransformer{InputFile: inputFile}
+}
+
+// crossReferenceFile is a Markdown file in the build with its headings.
+type crossReferenceFile struct {
+	Source   []byte
+	Headings []*ast.Heading
+	Anchors  map[string]*ast.Heading
+}
+
+// crossReferenceLink is a link to a Markdown file found in file.
+type crossReferenceLink struct {
+	Link   *ast.Link
+	File   string
+	Source []byte
+}
+
+func (t *CrossReferenceASTTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	files := make(map[string]*crossReferenceFile)
+	links := make([]crossReferenceLink, 0)
+	labels := make(map[string]bool)
+
+	stack := []*Transclusion{NewTransclusion(t.InputFile, reader.Source())}
+	files[t.InputFile] = &crossReferenceFile{Source: reader.Source(), Anchors: make(map[string]*ast.Heading)}
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if n, ok := n.(*Transclusion); ok {
+			if entering {
+				stack = append(stack, n)
+				if files[n.File] == nil {
+					files[n.File] = &crossReferenceFile{Source: n.Source, Anchors: make(map[string]*ast.Heading)}
+				}
+			} else {
+				stack = stack[:len(stack)-1]
+			}
+			return ast.WalkContinue, nil
+		}
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		top := stack[len(stack)-1]
+		f := files[top.File]
+		if id, ok := attributeString(n, "id"); ok {
+			labels[id] = true
+		}
+		switch n := n.(type) {
+		case *ast.Heading:
+			f.Headings = append(f.Headings, n)
+			if id, ok := attributeString(n, "id"); ok {
+				f.Anchors[id] = n
+			}
+			anchor := headingAnchor(plainText(n, top.Source))
+			for i := 1; f.Anchors[anchor] != nil; i++ {
+				anchor = fmt.Sprintf("%s-%d", headingAnchor(plainText(n, top.Source)), i)
+			}
+			f.Anchors[anchor] = n
+		case *ast.Link:
+			if isMarkdownLink(n.Destination) {
+				links = append(links, crossReferenceLink{Link: n, File: top.File, Source: top.Source})
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for _, l := range links {
+		pos := fmt.Sprintf("%s:%d", l.File, lineNumber(l.Link, l.Source))
+		name, anchor, _ := strings.Cut(string(l.Link.Destination), "#")
+		target := l.File
+		if name != "" {
+			target = filepath.Join(filepath.Dir(l.File), filepath.FromSlash(name))
+		}
+		anchor, err := url.PathUnescape(anchor)
+		if err != nil {
+			addError(pc, fmt.Errorf("%s: link %s: %w", pos, l.Link.Destination, err))
+			continue
+		}
+
+		f, ok := files[target]
+		if !ok {
+			slog.Warn("link shown as text", "pos", pos, "dest", string(l.Link.Destination), "err", errNotInBuild)
+			replaceWithChildren(l.Link)
+			continue
+		}
+		var heading *ast.Heading
+		if anchor == "" && len(f.Headings) != 0 {
+			heading = f.Headings[0]
+		} else {
+			heading = f.Anchors[anchor]
+		}
+		if heading == nil {
+			addError(pc, fmt.Errorf("%s: link %s: no such heading", pos, l.Link.Destination))
+			continue
+		}
+
+		label, ok := attributeString(heading, "id")
+		if !ok {
+			base := headingAnchor(plainText(heading, f.Source))
+			if base == "" {
+				base = "section"
+			}
+			label = base
+			for i := 1; labels[label]; i++ {
+				label = fmt.Sprintf("%s-%d", base, i)
+			}
+			labels[label] = true
+			heading.SetAttributeString("id", []byte(label))
+		}
+
+		ref := NewCrossReference(label)
+		for c := l.Link.FirstChild(); c != nil; c = l.Link.FirstChild() {
+			ref.AppendChild(ref, c)
+		}
+		l.Link.Parent().ReplaceChild(l.Link.Parent(), l.Link, ref)
+	}
+}
+
+// isMarkdownLink reports whether destination refers to a Markdown file
+// or to a heading of the current file.
+func isMarkdownLink(destination []byte) bool {
+	if bytes.HasPrefix(destination, []byte("#")) {
+		return true
+	}
+	if !isLocalPath(destination) {
+		return false
+	}
+	name, _, _ := bytes.Cut(destination, []byte("#"))
+	return strings.EqualFold(path.Ext(string(name)), ".md")
+}
+
+// headingAnchor returns the anchor GitHub gives a heading with text: the
+// text in lower case without punctuation and with hyphens for spaces.
+func headingAnchor(text []byte) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(strings.TrimSpace(string(text))) {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), r == '_', r == '-':
+			b.WriteRune(r)
+		case r == ' ':
+			b.WriteRune('-')
+		}
+	}
+	return b.String()
+}
+
+// replaceWithChildren replaces n with its children.
+func replaceWithChildren(n ast.Node) {
+	parent := n.Parent()
+	for c := n.FirstChild(); c != nil; c = n.FirstChild() {
+		parent.InsertBefore(parent, n, c)
+	}
+	parent.RemoveChild(parent, n)
+}
+
+var KindCitation = ast.NewNodeKind("Citation")
+
+// CitationItem cites the bibliography entry Key, optionally at a locator
+// such as p. 12 given by Supplement.
+type CitationItem struct {
+	Key        string
+	Supplement string
+}
+
+// Citation cites bibliography entries, either in brackets as in
+// [@key, p. 12; @other] or in the running text as in @key, which is Prose.
+// Segment is its source text.
+type Citation struct {
+	ast.BaseInline
+	Items   []CitationItem
+	Prose   bool
+	Segment text.Segment
+}
+
+func NewCitation(items []CitationItem, prose bool, segment text.Segment) *Citation {
+	return &Citation{Items: items, Prose: prose, Segment: segment}
+}
+
+func (n *Citation) Kind() ast.NodeKind {
+	return KindCitation
+}
+
+func (n *Citation) Dump(source []byte, level int) {
+	keys := make([]string, 0, len(n.Items))
+	for _, item := range n.Items {
+		keys = append(keys, item.Key)
+	}
+	ast.DumpHelper(n, source, level, map[string]string{"Keys": strings.Join(keys, ", "), "Prose": strconv.FormatBool(n.Prose)}, nil)
+}
+
+// citationKey matches a citation key as Pandoc reads it: letters, digits
+// and underscores with internal punctuation.
+const citationKey = `[\p{L}\p{N}_](?:[\p{L}\p{N}_:.#$%&+?<>~/-]*[\p{L}\p{N}_])?`
+
+var (
+	citationPattern     = regexp.MustCompile(`^@(` + citationKey + `)`)
+	citationItemPattern = regexp.MustCompile(`^@(` + citationKey + `)(?:\s*,\s*(.*))?$`)
+)
+
+// CitationParser parses Pandoc-style citations: [@key], [@key, p. 12],
+// [@a; @b] and @key in the running text. Brackets followed by a link
+// destination or label are left to links.
+type CitationParser struct{}
+
+func NewCitationParser() *CitationParser {
+	return &CitationParser{}
+}
+
+func (p *CitationParser) Trigger() []byte {
+	return []byte{'[', '@'}
+}
+
+func (p *CitationParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, segment := block.PeekLine()
+
+	if line[0] == '@' {
+		if r := block.PrecendingCharacter(); unicode.IsLetter(r) || unicode.IsDigit(r) || r == '[' {
+			return nil
+		}
+		m := citationPattern.FindSubmatch(line)
+		if m == nil {
+			return nil
+		}
+		block.Advance(len(m[0]))
+		return NewCitation([]CitationItem{{Key: string(m[1])}}, true, segment.WithStop(segment.Start+len(m[0])))
+	}
+
+	end := bytes.IndexAny(line[1:], "[]")
+	if end < 0 || line[1+end] != ']' {
+		return nil
+	}
+	end++
+	if end+1 < len(line) && (line[end+1] == '(' || line[end+1] == '[') {
+		return nil
+	}
+	items := make([]CitationItem, 0)
+	for _, item := range bytes.Split(line[1:end], []byte(";")) {
+		m := citationItemPattern.FindSubmatch(bytes.TrimSpace(item))
+		if m == nil {
+			return nil
+		}
+		items = append(items, CitationItem{Key: string(m[1]), Supplement: string(bytes.TrimSpace(m[2]))})
+	}
+	block.Advance(end + 1)
+	return NewCitation(items, false, segment.WithStop(segment.Start+end+1))
+}
+
+var KindBibliography = ast.NewNodeKind("Bibliography")
+
+// Bibliography lists the references cited in the document. Files are the
+// bibliography files and Keys are the keys of their entries. Style is a
+// .csl file, the name of a style built into Typst or empty for the style
+// of the document language.
+type Bibliography struct {
+	ast.BaseBlock
+	Files []string
+	Keys  map[string]bool
+	Style string
+}
+
+func NewBibliography(files []string, keys map[string]bool, style string) *Bibliography {
+	return &Bibliography{Files: files, Keys: keys, Style: style}
+}
+
+func (n *Bibliography) Kind() ast.NodeKind {
+	return KindBibliography
+}
+
+func (n *Bibliography) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Files": strings.Join(n.Files, ", "), "Style": n.Style}, nil)
+}
+
+// BibliographyASTTransformer puts a bibliography at the end of the
+// document if its metadata lists bibliography files, in the citation style
+// of the metadata. The files and .csl styles are read relative to the
+// directory of the input file, and AssetASTTransformer brings them into
+// the Typst project root like other assets. Russian documents without a
+// style get the bundled GOST style, written to CacheDir.
+type BibliographyASTTransformer struct {
+	InputFile string
+	CacheDir  string
+}
+
+func NewBibliographyASTTransformer(inputFile, cacheDir string) *BibliographyASTTransformer {
+	return &BibliographyASTTransformer{InputFile: inputFile, CacheDir: cacheDir}
+}
+
+func (t *BibliographyASTTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	m := documentMetadata(pc)
+	names := m.Bibliography
+	if len(names) == 0 {
+		return
+	}
+	dir, err := filepath.Abs(filepath.Dir(t.InputFile))
+	if err != nil {
+		addError(pc, err)
+		return
+	}
+
+	files := make([]string, 0, len(names))
+	keys := make(map[string]bool)
+	for _, name := range names {
+		p := filepath.FromSlash(name)
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(dir, p)
+		}
+		fileKeys, err := ReadBibliographyKeys(p)
+		if err != nil {
+			var pathErr *fs.PathError
+			if errors.As(err, &pathErr) {
+				err = pathErr.Err
+			}
+			addError(pc, fmt.Errorf("%s: bibliography %s: %w", t.InputFile, name, err))
+			continue
+		}
+		files = append(files, p)
+		maps.Copy(keys, fileKeys)
+	}
+
+	style := m.CSL
+	switch {
+	case style == "" && (m.Lang == "" || m.Lang == "ru") && t.CacheDir != "":
+		// The template's language is Russian.
+		style, err = GOSTStyleFile(t.CacheDir)
+		if err != nil {
+			addError(pc, fmt.Errorf("%s: csl: %w", t.InputFile, err))
+			return
+		}
+	case strings.HasSuffix(style, ".csl"):
+		style = filepath.FromSlash(style)
+		if !filepath.IsAbs(style) {
+			style = filepath.Join(dir, style)
+		}
+		if _, err := os.Stat(style); err != nil {
+			addError(pc, fmt.Errorf("%s: csl %s: %w", t.InputFile, m.CSL, errors.Unwrap(err)))
+			return
+		}
+	}
+
+	if len(files) != 0 {
+		doc.AppendChild(doc, NewBibliography(files, keys, style))
+	}
+}
+
+// CitationKeyASTTransformer checks that the keys cited in the document
+// and in the files it includes are in its bibliography. Typst takes a
+// single bibliography, so the bibliographies of the files are merged into
+// the last one, which keeps its style or takes the first one given. A
+// document without a bibliography cites nothing, so its citations are
+// turned back into text, such as a handle like @name.
+type CitationKeyASTTransformer struct {
+	InputFile string
+}
+
+func NewCitationKeyASTTransformer(inputFile string) *CitationKeyASTTransformer {
+	return &CitationKeyASTTransformer{InputFile: inputFile}
+}
+
+func (t *CitationKeyASTTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	bibliographies := make([]*Bibliography, 0)
+	citations := make([]*Citation, 0)
+	positions := make([]string, 0)
+
+	walkFiles(doc, t.InputFile, reader.Source(), func(n ast.Node, file string, source []byte) ast.WalkStatus {
+		switch n := n.(type) {
+		case *Bibliography:
+			bibliographies = append(bibliographies, n)
+		case *Citation:
+			citations = append(citations, n)
+			positions = append(positions, fmt.Sprintf("%s:%d", file, lineNumber(n, source)))
+		}
+		return ast.WalkContinue
+	})
+
+	var bibliography *Bibliography
+	if len(bibliographies) != 0 {
+		bibliography = bibliographies[len(bibliographies)-1]
+		files := make([]string, 0)
+		for _, n := range bibliographies {
+			files = append(files, n.Files...)
+			maps.Copy(bibliography.Keys, n.Keys)
+			if bibliography.Style == "" {
+				bibliography.Style = n.Style
+			}
+			if n != bibliography {
+				n.Parent().RemoveChild(n.Parent(), n)
+			}
+		}
+		bibliography.Files = files
+	}
+
+	// Without a bibliography, text such as @name is no citation.
+	if bibliography == nil {
+		for _, n := range citations {
+			n.Parent().ReplaceChild(n.Parent(), n, ast.NewTextSegment(n.Segment))
+		}
+		return
+	}
+
+	for i, n := range citations {
+		for _, item := range n.Items {
+			if !bibliography.Keys[item.Key] {
+				addError(pc, fmt.Errorf("%s: citation %s: no such key in the bibliography", positions[i], item.Key))
+			}
+		}
+	}
+}
+
+var KindTitle = ast.NewNodeKind("Title")
+
+// Title is the title of the document as plain text.
+type Title struct {
+	ast.BaseBlock
+	PlainText string
+}
+
+func NewTitle(plainText string) *Title {
+	return &Title{PlainText: plainText}
+}
+
+func (n *Title) Kind() ast.NodeKind {
+	return KindTitle
+}
+
+func (n *Title) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"PlainText": n.PlainText}, nil)
+}
+
+// HeadingShiftASTTransformer shifts the levels of all headings by Shift,
+// keeping them between 1 and 6. With TitleFromHeading, a level 1 heading
+// that is the only one in the document becomes its title, moved to the
+// start, and the other headings are promoted one level further.
+type HeadingShiftASTTransformer struct {
+	InputFile        string
+	Shift            int
+	TitleFromHeading bool
+}
+
+func NewHeadingShiftASTTransformer(inputFile string, shift int, titleFromHeading bool) *HeadingShiftASTTransformer {
+	return &HeadingShiftASTTransformer{InputFile: inputFile, Shift: shift, TitleFromHeading: titleFromHeading}
+}
+
+func (t *HeadingShiftASTTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	headings := make([]*ast.Heading, 0)
+	var top *ast.Heading
+	var topSource []byte
+	tops := 0
+
+	walkFiles(doc, t.InputFile, reader.Source(), func(n ast.Node, file string, source []byte) ast.WalkStatus {
+		if n, ok := n.(*ast.Heading); ok {
+			headings = append(headings, n)
+			if n.Level == 1 {
+				top, topSource = n, source
+				tops++
+			}
+		}
+		return ast.WalkContinue
+	})
+
+	shift := t.Shift
+	if t.TitleFromHeading && tops == 1 {
+		// Typst wants the title set before any content.
+		top.Parent().RemoveChild(top.Parent(), top)
+		title := NewTitle(string(plainText(top, topSource)))
+		c := doc.FirstChild()
+		for c != nil && c.Kind() == KindRawStyle {
+			c = c.NextSibling()
+		}
+		if c == nil {
+			doc.AppendChild(doc, title)
+		} else {
+			doc.InsertBefore(doc, c, title)
+		}
+		shift--
+	}
+	if shift == 0 {
+		return
+	}
+	for _, n := range headings {
+		n.Level = min(max(n.Level+shift, 1), 6)
+	}
+}
+
+// AttributeASTTransformer attaches a paragraph consisting solely of an
+// attribute list such as {#id .class key=value} to the preceding block,
+// an attribute list at the end of a heading to the heading, an attribute
+// list right after an image or inline code to it, and the info string of
+// a fenced code block after the language to the code block. The braces
+// may be left out in info strings. A - in an attribute list stands for
+// the unnumbered class, as in # Introduction {-}.
+type AttributeASTTransformer struct{}
+
+func NewAttributeASTTransformer() *AttributeASTTransformer {
+	return &AttributeASTTransformer{}
+}
+
+func (t *AttributeASTTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	attributeParagraphs := make([]*ast.Paragraph, 0)
+	attributeLists := make([][]ast.Attribute, 0)
+
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering {
+			if n.Kind() == ast.KindFencedCodeBlock {
+				n := n.(*ast.FencedCodeBlock)
+				if n.Info != nil {
+					info := n.Info.Segment.Value(reader.Source())
+					i := bytes.IndexAny(info, " \t")
+					if bytes.HasPrefix(info, []byte("{")) {
+						i = 0
+					}
+					if i >= 0 {
+						p := bytes.TrimSpace(info[i:])
+						attrs, l, err := parseAttributes(p)
+						if err == nil && l != len(p) {
+							err = errInvalidAttributes
+						}
+						if errors.Is(err, errInvalidAttributes) {
+							attrs, err = parseAttributeList(p)
+						}
+						switch {
+						case err == nil:
+							setAttributes(n, attrs)
+						case errors.Is(err, errEmptyAttributeName):
+							addError(pc, fmt.Errorf("%s: attributes %s: %w", position(pc, n, reader.Source()), p, err))
+						}
+					}
+				}
+			}
+			if n.Kind() == ast.KindParagraph && n.PreviousSibling() != nil {
+				p := bytes.TrimSpace(n.Lines().Value(reader.Source()))
+				attrs, l, err := parseAttributes(p)
+				switch {
+				case err == nil && l == len(p):
+					attributeParagraphs = append(attributeParagraphs, n.(*ast.Paragraph))
+					attributeLists = append(attributeLists, attrs)
+				case errors.Is(err, errEmptyAttributeName):
+					addError(pc, fmt.Errorf("%s: attributes %s: %w", position(pc, n, reader.Source()), p, err))
+				}
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for i, n := range attributeParagraphs {
+		setAttributes(n.PreviousSibling(), attributeLists[i])
+		n.Parent().RemoveChild(n.Parent(), n)
+	}
+
+	headings := make([]*ast.Heading, 0)
+
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering {
+			if n.Kind() == ast.KindHeading {
+				headings = append(headings, n.(*ast.Heading))
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for _, n := range headings {
+		if n.Lines().Len() == 0 {
+			continue
+		}
+		source := reader.Source()
+		l := n.Lines().At(n.Lines().Len() - 1)
+		line := bytes.TrimRight(l.Value(source), " \t")
+		i := bytes.LastIndexByte(line, '{')
+		if i < 0 {
+			continue
+		}
+		attrs, length, err := parseAttributes(line[i:])
+		if errors.Is(err, errEmptyAttributeName) {
+			addError(pc, fmt.Errorf("%s: attributes %s: %w", position(pc, n, source), line[i:], err))
+			continue
+		}
+		if err != nil || length != len(line)-i {
+			continue
+		}
+		setAttributes(n, attrs)
+
+		// Cut the attribute list and the spaces before it off the text.
+		end := l.Start + len(bytes.TrimRight(line[:i], " \t"))
+		for c := n.LastChild(); c != nil; {
+			t, ok := c.(*ast.Text)
+			if !ok || t.Segment.Stop <= end {
+				break
+			}
+			prev := c.PreviousSibling()
+			if t.Segment.Start >= end {
+				n.RemoveChild(n, t)
+			} else {
+				t.Segment = t.Segment.WithStop(end)
+			}
+			c = prev
+		}
+	}
+
+	inlines := make([]ast.Node, 0)
+
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering {
+			if n.Kind() == ast.KindImage || n.Kind() == ast.KindCodeSpan {
+				if _, ok := n.NextSibling().(*ast.Text); ok {
+					inlines = append(inlines, n)
+				}
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for _, n := range inlines {
+		source := reader.Source()
+		start := n.NextSibling().(*ast.Text).Segment.Start
+		stop := start + bytes.IndexByte(source[start:], '\n')
+		if stop < start {
+			stop = len(source)
+		}
+		attrs, l, err := parseAttributes(source[start:stop])
+		if errors.Is(err, errEmptyAttributeName) {
+			addError(pc, fmt.Errorf("%s: attributes %s: %w", position(pc, n, source), source[start:start+l], err))
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		setAttributes(n, attrs)
+
+		// The attribute list is usually split into several text nodes.
+		end := start + l
+		for c := n.NextSibling(); c != nil; {
+			t, ok := c.(*ast.Text)
+			if !ok || t.Segment.Start >= end {
+				break
+			}
+			next := c.NextSibling()
+			if t.Segment.Stop <= end && !t.SoftLineBreak() && !t.HardLineBreak() {
+				n.Parent().RemoveChild(n.Parent(), t)
+			} else {
+				t.Segment = t.Segment.WithStart(min(end, t.Segment.Stop))
+			}
+			c = next
+		}
+	}
+
+	// Image sizes are checked here, where the errors have a position,
+	// whether they come from attributes or from a size suffix.
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering && n.Kind() == ast.KindImage {
+			if err := checkImageAttributes(n); err != nil {
+				addError(pc, fmt.Errorf("%s: image %s: %w", position(pc, n, reader.Source()), n.(*ast.Image).Destination, err))
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+}
+
+// ImageSizeParser parses images with a size suffix such as
+// ![alt](photo.jpg =300x200), which the link parser rejects. The suffix
+// sets the width and height attributes; either side may be omitted.
+type ImageSizeParser struct{}
+
+func NewImageSizeParser() *ImageSizeParser {
+	return &ImageSizeParser{}
+}
+
+var imageSizePattern = regexp.MustCompile(`^!\[([^\]]*)\]\(\s*([^\s()]+)\s+=([0-9.]*[a-z%]*)x([0-9.]*[a-z%]*)(?:\s+"((?:[^"\\]|\\.)*)")?\s*\)`)
+
+func (p *ImageSizeParser) Trigger() []byte {
+	return []byte{'!'}
+}
+
+func (p *ImageSizeParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, segment := block.PeekLine()
+	m := imageSizePattern.FindSubmatchIndex(line)
+	if m == nil {
+		return nil
+	}
+
+	link := ast.NewLink()
+	link.Destination = line[m[4]:m[5]]
+	if m[10] >= 0 {
+		link.Title = util.UnescapePunctuations(line[m[10]:m[11]])
+	}
+	image := ast.NewImage(link)
+	if m[3] > m[2] {
+		image.AppendChild(image, ast.NewTextSegment(text.NewSegment(segment.Start+m[2], segment.Start+m[3])))
+	}
+	if m[7] > m[6] {
+		image.SetAttributeString("width", line[m[6]:m[7]])
+	}
+	if m[9] > m[8] {
+		image.SetAttributeString("height", line[m[8]:m[9]])
+	}
+
+	block.Advance(m[1])
+	return image
+}
+
+var (
+	errInvalidAttributes  = errors.New("invalid attributes")
+	errEmptyAttributeName = errors.New("attribute without a name")
+)
+
+// parseAttributes parses a Pandoc-style attribute list at the start of p
+// and reports how many bytes it took. Unlike [parser.ParseAttributes],
+// unquoted values may contain any non-space characters, so paths and
+// ranges such as file=src/main.go and lines=10-42 need no quoting.
+func parseAttributes(p []byte) ([]ast.Attribute, int, error) {
+	if len(p) == 0 || p[0] != '{' {
+		return nil, 0, errInvalidAttributes
+	}
+	quoted := false
+	for i := 1; i < len(p); i++ {
+		switch {
+		case p[i] == '\\' && quoted:
+			i++
+		case p[i] == '"':
+			quoted = !quoted
+		case p[i] == '\n':
+			return nil, 0, errInvalidAttributes
+		case p[i] == '}' && !quoted:
+			attrs, err := parseAttributeList(p[1:i])
+			return attrs, i + 1, err
+		}
+	}
+	return nil, 0, errInvalidAttributes
+}
+
+// parseAttributeList parses the contents of an attribute list without
+// the surrounding braces.
+func parseAttributeList(p []byte) ([]ast.Attribute, error) {
+	attrs := []ast.Attribute{}
+	i := 0
+	for {
+		for i < len(p) && util.IsSpace(p[i]) {
+			i++
+		}
+		if i == len(p) {
+			return attrs, nil
+		}
+
+		start := i
+		for i < len(p) && !util.IsSpace(p[i]) && p[i] != '=' {
+			i++
+		}
+		name := p[start:i]
+		if len(name) == 0 {
+			return nil, errEmptyAttributeName
+		}
+
+		switch {
+		case name[0] == '#' && len(name) > 1:
+			attrs = append(attrs, ast.Attribute{Name: []byte("id"), Value: name[1:]})
+		case name[0] == '.' && len(name) > 1:
+			attrs = appendClass(attrs, name[1:])
+		case string(name) == "-":
+			attrs = appendClass(attrs, []byte("unnumbered"))
+		case i < len(p) && p[i] == '=':
+			i++
+			var value []byte
+			if i < len(p) && p[i] == '"' {
+				var buf bytes.Buffer
+				for i++; i < len(p) && p[i] != '"'; i++ {
+					if p[i] == '\\' && i+1 < len(p) {
+						i++
+					}
+					_ = buf.WriteByte(p[i])
+				}
+				if i == len(p) {
+					return nil, errInvalidAttributes
+				}
+				i++
+				value = buf.Bytes()
+			} else {
+				start = i
+				for i < len(p) && !util.IsSpace(p[i]) {
+					i++
+				}
+				value = p[start:i]
+			}
+			attrs = append(attrs, ast.Attribute{Name: name, Value: value})
+		default:
+			return nil, errInvalidAttributes
+		}
+	}
+}
+
+func appendClass(attrs []ast.Attribute, class []byte) []ast.Attribute {
+	for i, a := range attrs {
+		if string(a.Name) == "class" {
+			v := a.Value.([]byte)
+			attrs[i].Value = append(append(append([]byte{}, v...), ' '), class...)
+			return attrs
+		}
+	}
+	return append(attrs, ast.Attribute{Name: []byte("class"), Value: class})
+}
+
+// setAttributes sets attrs on n, merging classes with the ones n already has.
+func setAttributes(n ast.Node, attrs []ast.Attribute) {
+	for _, a := range attrs {
+		if string(a.Name) == "class" {
+			if v, ok := n.AttributeString("class"); ok {
+				merged := appendClass([]ast.Attribute{{Name: a.Name, Value: v}}, a.Value.([]byte))
+				n.SetAttribute(a.Name, merged[0].Value)
+				continue
+			}
+		}
+		n.SetAttribute(a.Name, a.Value)
+	}
+}
+
+// attributeString returns the value of the named attribute of n as a string.
+func attributeString(n ast.Node, name string) (string, bool) {
+	v, ok := n.AttributeString(name)
+	if !ok {
+		return "", false
+	}
+	switch v := v.(type) {
+	case []byte:
+		return string(v), true
+	case string:
+		return v, true
+	default:
+		return fmt.Sprint(v), true
+	}
+}
+
+// hasClass reports whether n has class among its classes.
+func hasClass(n ast.Node, class string) bool {
+	v, ok := attributeString(n, "class")
+	if !ok {
+		return false
+	}
+	for _, c := range strings.Fields(v) {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// AssetASTTransformer resolves local image paths relative to the
+// directory of the input file, checks that they exist and runs them
+// through Pipeline if it is set. Typst only reads files inside its
+// project root, so the transformer picks the closest directory containing
+// the input and every asset as the root and rewrites the paths to be
+// absolute within it. The files of raw styles and bibliographies count as
+// assets too.
+type AssetASTTransformer struct {
+	InputFile string
+	Pipeline  *AssetPipeline
+}
+
+func NewAssetASTTransformer(inputFile string, pipeline *AssetPipeline) *AssetASTTransformer {
+	return &AssetASTTransformer{InputFile: inputFile, Pipeline: pipeline}
+}
+
+var assetRootKey = parser.NewContextKey()
+
+// assetRoot returns the Typst project root chosen while parsing.
+func assetRoot(pc parser.Context) string {
+	root, _ := pc.Get(assetRootKey).(string)
+	return root
+}
+
+func (t *AssetASTTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+
+	dir, err := filepath.Abs(filepath.Dir(t.InputFile))
+	if err != nil {
+		addError(pc, err)
+		return
+	}
+	root := dir
+
+	images := make([]*ast.Image, 0)
+	paths := make([]string, 0)
+	rawStyles := make([]*RawStyle, 0)
+	bibliographies := make([]*Bibliography, 0)
+
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering {
+			if n.Kind() == KindRawStyle {
+				n := n.(*RawStyle)
+				for _, p := range append([]string{n.Theme}, n.Syntaxes...) {
+					if p == "" {
+						continue
+					}
+					if root, err = commonRoot(root, p); err != nil {
+						addError(pc, fmt.Errorf("%s: raw style: %w", t.InputFile, err))
+						return ast.WalkContinue, nil
+					}
+				}
+				rawStyles = append(rawStyles, n)
+			}
+			if n.Kind() == KindBibliography {
+				n := n.(*Bibliography)
+				for _, p := range append(slices.Clone(n.Files), n.Style) {
+					if !filepath.IsAbs(p) {
+						continue
+					}
+					if root, err = commonRoot(root, p); err != nil {
+						addError(pc, fmt.Errorf("%s: bibliography: %w", t.InputFile, err))
+						return ast.WalkContinue, nil
+					}
+				}
+				bibliographies = append(bibliographies, n)
+			}
+			if n.Kind() == ast.KindImage {
+				n := n.(*ast.Image)
+				name := string(n.Destination)
+				var p string
+				switch {
+				case bytes.HasPrefix(n.Destination, []byte("data:")):
+					// SVG stays inline, other data goes to the cache.
+					name = "data URI"
+					mediaType, data, err := decodeDataURI(n.Destination)
+					if err != nil {
+						addError(pc, fmt.Errorf("%s:%d: image %s: %w", t.InputFile, lineNumber(n, source), name, err))
+						return ast.WalkContinue, nil
+					}
+					if mediaType == "image/svg+xml" || t.Pipeline == nil {
+						return ast.WalkContinue, nil
+					}
+					p, err = t.Pipeline.Store(data, mediaTypeExtension(mediaType))
+					if err != nil {
+						addError(pc, fmt.Errorf("%s:%d: image %s: %w", t.InputFile, lineNumber(n, source), name, err))
+						return ast.WalkContinue, nil
+					}
+				case isLocalPath(n.Destination):
+					var err error
+					p, err = url.PathUnescape(string(n.Destination))
+					if err != nil {
+						p = string(n.Destination)
+					}
+					if !filepath.IsAbs(p) {
+						p = filepath.Join(dir, p)
+					}
+					if _, err := os.Stat(p); err != nil {
+						addError(pc, fmt.Errorf("%s:%d: image %s: %w", t.InputFile, lineNumber(n, source), name, errors.Unwrap(err)))
+						return ast.WalkContinue, nil
+					}
+				default:
+					return ast.WalkContinue, nil
+				}
+				if t.Pipeline != nil {
+					width, height, err := imageSize(n)
+					if err == nil {
+						p, err = t.Pipeline.Process(p, width, height)
+					}
+					if err != nil {
+						addError(pc, fmt.Errorf("%s:%d: image %s: %w", t.InputFile, lineNumber(n, source), name, err))
+						return ast.WalkContinue, nil
+					}
+				}
+				if root, err = commonRoot(root, p); err != nil {
+					addError(pc, fmt.Errorf("%s:%d: image %s: %w", t.InputFile, lineNumber(n, source), name, err))
+					return ast.WalkContinue, nil
+				}
+				images = append(images, n)
+				paths = append(paths, p)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for i, n := range images {
+		rel, err := filepath.Rel(root, paths[i])
+		if err != nil {
+			addError(pc, err)
+			continue
+		}
+		n.Destination = []byte("/" + filepath.ToSlash(rel))
+	}
+	rootPath := func(p string) string {
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			addError(pc, err)
+			return p
+		}
+		return "/" + filepath.ToSlash(rel)
+	}
+	for _, n := range rawStyles {
+		if n.Theme != "" {
+			n.Theme = rootPath(n.Theme)
+		}
+		for i := range n.Syntaxes {
+			n.Syntaxes[i] = rootPath(n.Syntaxes[i])
+		}
+	}
+	for _, n := range bibliographies {
+		for i := range n.Files {
+			n.Files[i] = rootPath(n.Files[i])
+		}
+		if filepath.IsAbs(n.Style) {
+			n.Style = rootPath(n.Style)
+		}
+	}
+	pc.Set(assetRootKey, root)
+}
+
+// checkImageAttributes returns an error if the width, height or fit
+// attribute of image n isn't one Typst takes.
+func checkImageAttributes(n ast.Node) error {
+	for _, name := range []string{"width", "height"} {
+		if v, ok := attributeString(n, name); ok {
+			if _, err := typstLength(v); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	if v, ok := attributeString(n, "fit"); ok {
+		switch v {
+		case "cover", "contain", "stretch":
+		default:
+			return fmt.Errorf("fit: invalid value %q, want cover, contain or stretch", v)
+		}
+	}
+	return nil
+}
+
+// imageSize returns the size image n takes up on the page in inches as
+// the renderer lays it out. Either dimension may be zero when it follows
+// from the other one.
+func imageSize(n *ast.Image) (width, height float64, err error) {
+	if v, ok := attributeString(n, "width"); ok {
+		width, err = lengthInches(v)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if v, ok := attributeString(n, "height"); ok {
+		height, err = lengthInches(v)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if width == 0 && height == 0 {
+		if n.Parent().Kind() == KindImageBlock {
+			width = textWidth / float64(n.Parent().ChildCount())
+		} else {
+			height = fontSize
+		}
+	}
+	return width, height, nil
+}
+
+// isLocalPath reports whether destination refers to a local file rather
+// than a URL.
+func isLocalPath(destination []byte) bool {
+	u, err := url.Parse(string(destination))
+	if err != nil {
+		return true
+	}
+	return u.Scheme == "" || len(u.Scheme) == 1 // Windows drive letter
+}
+
+// commonRoot returns root or its nearest parent that contains path. It
+// fails when no directory up to the filesystem root does, which happens
+// for a relative path.
+func commonRoot(root, path string) (string, error) {
+	for !isWithin(root, path) {
+		parent := filepath.Dir(root)
+		if parent == root {
+			return "", fmt.Errorf("%s is outside %s", path, root)
+		}
+		root = parent
+	}
+	return root, nil
+}
+
+// isWithin reports whether path is dir or lies inside it.
+func isWithin(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+var errorsKey = parser.NewContextKey()
+
+// addError records an error found in the document. AST transformers
+// can't return errors, so callers check parseErrors after parsing.
+func addError(pc parser.Context, err error) {
+	errs, _ := pc.Get(errorsKey).([]error)
+	pc.Set(errorsKey, append(errs, err))
+}
+
+// parseErrors returns the errors recorded with addError.
+func parseErrors(pc parser.Context) error {
+	errs, _ := pc.Get(errorsKey).([]error)
+	return errors.Join(errs...)
+}
+
+var inputFileKey = parser.NewContextKey()
+
+// position returns the input file and line of n for error messages. The
+// input file is known when the caller sets it in the context with
+// inputFileKey.
+func position(pc parser.Context, n ast.Node, source []byte) string {
+	inputFile, _ := pc.Get(inputFileKey).(string)
+	return fmt.Sprintf("%s:%d", inputFile, lineNumber(n, source))
+}
+
+// lineNumber returns the 1-based source line of n, or of the block
+// containing it for inline nodes without a position of their own.
+func lineNumber(n ast.Node, source []byte) int {
+	block := n
+	for block.Type() != ast.TypeBlock && block.Parent() != nil {
+		block = block.Parent()
+	}
+	if fence, ok := block.(*ast.FencedCodeBlock); ok && fence.Info != nil {
+		// Point at the opening fence, which carries the attributes.
+		return 1 + bytes.Count(source[:fence.Info.Segment.Start], []byte("\n"))
+	}
+	lines := block.Lines()
+	if lines == nil || lines.Len() == 0 {
+		return 1
+	}
+	start := lines.At(0).Start
+	if image, ok := n.(*ast.Image); ok {
+		for i := 0; i < lines.Len(); i++ {
+			l := lines.At(i)
+			if bytes.Contains(l.Value(source), image.Destination) {
+				start = l.Start
+				break
+			}
+		}
+	}
+	return 1 + bytes.Count(source[:start], []byte("\n"))
+}
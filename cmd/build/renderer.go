@@ -3,7 +3,9 @@ package main
 import (
 	"bytes"
 	_ "embed"
+	"fmt"
 	"log/slog"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -26,18 +28,23 @@ func (r *Renderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
 	reg.Register(ast.KindBlockquote, r.renderBlockquote)
 	reg.Register(ast.KindCodeBlock, r.renderCodeBlock)
 	reg.Register(ast.KindFencedCodeBlock, r.renderFencedCodeBlock)
+	reg.Register(KindListingBlock, r.renderListingBlock)
 	reg.Register(ast.KindHTMLBlock, r.renderHTMLBlock)
 	reg.Register(ast.KindList, r.renderList)
 	reg.Register(ast.KindListItem, r.renderListItem)
 	reg.Register(ast.KindParagraph, r.renderParagraph)
 	reg.Register(ast.KindTextBlock, r.renderTextBlock)
 	reg.Register(ast.KindThematicBreak, r.renderThematicBreak)
+	reg.Register(KindTitle, r.renderTitle)
+	reg.Register(KindLanguage, r.renderLanguage)
+	reg.Register(KindChapterNumbering, r.renderChapterNumbering)
 
 	reg.Register(ast.KindAutoLink, r.renderAutoLink)
 	reg.Register(ast.KindCodeSpan, r.renderCodeSpan)
 	reg.Register(ast.KindEmphasis, r.renderEmphasis)
 	reg.Register(ast.KindImage, r.renderImage)
 	reg.Register(ast.KindLink, r.renderLink)
+	reg.Register(KindCrossReference, r.renderCrossReference)
 	reg.Register(ast.KindRawHTML, r.renderRawHTML)
 	reg.Register(ast.KindText, r.renderText)
 	reg.Register(ast.KindString, r.renderString)
@@ -57,10 +64,44 @@ func (r *Renderer) renderDocument(w util.BufWriter, source []byte, node ast.Node
 func (r *Renderer) renderHeading(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
 	if entering {
 		n := node.(*ast.Heading)
-		_, _ = w.WriteString(strings.Repeat("=", n.Level))
-		_, _ = w.WriteRune(' ')
+		unnumbered := hasClass(n, "unnumbered")
+		unlisted := hasClass(n, "unlisted")
+		if unnumbered || unlisted {
+			_, _ = w.WriteString("#")
+			_, _ = w.WriteString("heading")
+			_, _ = w.WriteString("(")
+			_, _ = w.WriteString("level: ")
+			_, _ = w.WriteString(strconv.Itoa(n.Level))
+			if unnumbered {
+				_, _ = w.WriteString(", ")
+				_, _ = w.WriteString("numbering: none")
+			}
+			if unlisted {
+				_, _ = w.WriteString(", ")
+				_, _ = w.WriteString("outlined: false")
+			}
+			_, _ = w.WriteString(")")
+			_, _ = w.WriteString("[")
+		} else {
+			_, _ = w.WriteString(strings.Repeat("=", n.Level))
+			_, _ = w.WriteRune(' ')
+		}
 	} else {
+		if hasClass(node, "unnumbered") || hasClass(node, "unlisted") {
+			_, _ = w.WriteString("]")
+			_, _ = w.WriteString(";")
+		}
 		_, _ = w.WriteRune('\n')
+		if id, ok := attributeString(node, "id"); ok {
+			_, _ = w.WriteString("#")
+			_, _ = w.WriteString("label")
+			_, _ = w.WriteString("(")
+			_, _ = w.WriteString(`"`)
+			strWrite(w, []byte(id))
+			_, _ = w.WriteString(`"`)
+			_, _ = w.WriteString(")")
+			_, _ = w.WriteString(";\n")
+		}
 		if node.NextSibling() != nil {
 			_, _ = w.WriteRune('\n')
 		}
@@ -68,69 +109,104 @@ func (r *Renderer) renderHeading(w util.BufWriter, source []byte, node ast.Node,
 	return ast.WalkContinue, nil
 }
 
-func (r *Renderer) renderBlockquote(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
-	slog.Error("unimplemented renderBlockquote")
-	return ast.WalkContinue, nil
-}
-
-func (r *Renderer) renderCodeBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
-	slog.Error("unimplemented renderCodeBlock")
-	return ast.WalkContinue, nil
-}
-
-func (r *Renderer) renderFencedCodeBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+func (r *Renderer) renderTitle(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
 	if entering {
-		n := node.(*ast.FencedCodeBlock)
+		n := node.(*Title)
 		_, _ = w.WriteString("#")
-		_, _ = w.WriteString("figure")
-		_, _ = w.WriteString("(\n")
-
-		// TODO: Get caption from attributes.
-		_, _ = w.WriteString("caption: ")
+		_, _ = w.WriteString("set")
+		_, _ = w.WriteString(" ")
+		_, _ = w.WriteString("document")
+		_, _ = w.WriteString("(")
+		_, _ = w.WriteString("title: ")
 		_, _ = w.WriteString(`"`)
-		strWrite(w, []byte("Lorem ipsum."))
+		strWrite(w, []byte(n.PlainText))
 		_, _ = w.WriteString(`"`)
-		_, _ = w.WriteString(",\n")
+		_, _ = w.WriteString(")")
+		_, _ = w.WriteString(";\n")
 
-		_, _ = w.WriteString("raw")
+		_, _ = w.WriteString("#")
+		_, _ = w.WriteString("papermark-title")
 		_, _ = w.WriteString("(")
-
-		_, _ = w.WriteString("block: ")
-		_, _ = w.WriteString("true")
-		_, _ = w.WriteString(", ")
-
-		if lang := n.Language(source); lang != nil {
-			_, _ = w.WriteString("lang: ")
-			_, _ = w.WriteString(`"`)
-			strWrite(w, lang)
-			_, _ = w.WriteString(`"`)
-			_, _ = w.WriteString(", ")
-		}
-
 		_, _ = w.WriteString(`"`)
-		for i := 0; i < n.Lines().Len(); i++ {
-			l := n.Lines().At(i)
-			strWrite(w, l.Value(source))
-		}
+		strWrite(w, []byte(n.PlainText))
 		_, _ = w.WriteString(`"`)
-
-		_, _ = w.WriteString(")")
-		_, _ = w.WriteString(",\n")
-
 		_, _ = w.WriteString(")")
 		_, _ = w.WriteString(";\n")
+		if node.NextSibling() != nil {
+			_, _ = w.WriteString("\n")
+		}
+	}
+	return ast.WalkSkipChildren, nil
+}
 
+func (r *Renderer) renderLanguage(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	n := node.(*Language)
+	if entering {
 		_, _ = w.WriteString("#")
-		_, _ = w.WriteString("label")
+		_, _ = w.WriteString("set")
+		_, _ = w.WriteString(" ")
+		_, _ = w.WriteString("text")
 		_, _ = w.WriteString("(")
-
-		// TODO: Get label from attributes.
+		_, _ = w.WriteString("lang: ")
 		_, _ = w.WriteString(`"`)
-		strWrite(w, []byte("lorem"))
+		_, _ = w.WriteString(n.Lang)
 		_, _ = w.WriteString(`"`)
-
 		_, _ = w.WriteString(")")
-		_, _ = w.WriteString(";\n")
+		_, _ = w.WriteString("\n")
+		if node.NextSibling() != nil {
+			_, _ = w.WriteString("\n")
+		}
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+func (r *Renderer) renderChapterNumbering(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		_, _ = w.WriteString("#")
+		_, _ = w.WriteString("show")
+		_, _ = w.WriteString(": ")
+		_, _ = w.WriteString("papermark-chapter-numbering")
+		_, _ = w.WriteString("\n")
+		if node.NextSibling() != nil {
+			_, _ = w.WriteString("\n")
+		}
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+func (r *Renderer) renderBlockquote(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	slog.Error("unimplemented renderBlockquote")
+	return ast.WalkContinue, nil
+}
+
+func (r *Renderer) renderCodeBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	slog.Error("unimplemented renderCodeBlock")
+	return ast.WalkContinue, nil
+}
+
+func (r *Renderer) renderFencedCodeBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		lang, code, _ := listingCode(node, source)
+		err := listingWrite(w, node, lang, code)
+		if err != nil {
+			return ast.WalkStop, err
+		}
+		if node.NextSibling() != nil {
+			_, _ = w.WriteString("\n")
+		}
+		return ast.WalkSkipChildren, nil
+	} else {
+		return ast.WalkContinue, nil
+	}
+}
+
+func (r *Renderer) renderListingBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		lang, code, _ := listingCode(node, source)
+		err := listingWrite(w, node, lang, code)
+		if err != nil {
+			return ast.WalkStop, err
+		}
 		if node.NextSibling() != nil {
 			_, _ = w.WriteString("\n")
 		}
@@ -160,6 +236,12 @@ func (r *Renderer) renderList(w util.BufWriter, source []byte, node ast.Node, en
 		_, _ = w.WriteString(strconv.FormatBool(n.IsTight))
 		_, _ = w.WriteString(",\n")
 
+		if isCalloutList(n, source) {
+			_, _ = w.WriteString("numbering: ")
+			_, _ = w.WriteString("papermark-callout")
+			_, _ = w.WriteString(",\n")
+		}
+
 		if n.IsOrdered() && n.Start != 1 {
 			_, _ = w.WriteString("start: ")
 			_, _ = w.WriteString(strconv.Itoa(n.Start))
@@ -225,6 +307,13 @@ func (r *Renderer) renderCodeSpan(w util.BufWriter, source []byte, n ast.Node, e
 		_, _ = w.WriteString("#raw")
 		_, _ = w.WriteRune('(')
 		_, _ = w.WriteString("block: false, ")
+		if lang, ok := attributeString(n, "lang"); ok {
+			_, _ = w.WriteString("lang: ")
+			_, _ = w.WriteRune('"')
+			strWrite(w, []byte(lang))
+			_, _ = w.WriteRune('"')
+			_, _ = w.WriteString(", ")
+		}
 		_, _ = w.WriteRune('"')
 		for c := n.FirstChild(); c != nil; c = c.NextSibling() {
 			v := c.(*ast.Text).Value(source)
@@ -263,16 +352,131 @@ func (r *Renderer) renderEmphasis(w util.BufWriter, source []byte, node ast.Node
 func (r *Renderer) renderImage(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
 	if entering {
 		n := node.(*ast.Image)
+
+		// Images in running text are sized to the line unless told otherwise.
+		inline := n.Parent().Kind() != KindImageBlock
+		_, hasWidth := n.AttributeString("width")
+		_, hasHeight := n.AttributeString("height")
+
+		// Images of a group become grid cells with sub-figures
+		// captioned with their alt text.
+		cell := !inline && n.Parent().ChildCount() > 1
+		subfigure := cell && !hasClass(n.Parent(), "nofigure")
+		if cell {
+			_, _ = w.WriteString("[")
+		}
+		if subfigure {
+			_, _ = w.WriteString("#")
+			_, _ = w.WriteString("figure")
+			_, _ = w.WriteString("(\n")
+
+			_, _ = w.WriteString("kind: ")
+			_, _ = w.WriteString(`"subfigure"`)
+			_, _ = w.WriteString(",\n")
+
+			_, _ = w.WriteString("supplement: ")
+			_, _ = w.WriteString("none")
+			_, _ = w.WriteString(",\n")
+
+			_, _ = w.WriteString("numbering: ")
+			_, _ = w.WriteString(`"(a)"`)
+			_, _ = w.WriteString(",\n")
+
+			if alt := plainText(n, source); len(alt) > 0 {
+				_, _ = w.WriteString("caption: ")
+				_, _ = w.WriteString(`"`)
+				strWrite(w, alt)
+				_, _ = w.WriteString(`"`)
+				_, _ = w.WriteString(",\n")
+			}
+
+			_, _ = w.WriteString("[")
+		}
+
 		_, _ = w.WriteString("#")
+		if inline {
+			_, _ = w.WriteString("box")
+			_, _ = w.WriteString("(")
+		}
 		_, _ = w.WriteString("image")
 		_, _ = w.WriteString("(")
 
-		_, _ = w.WriteString(`"`)
-		strWrite(w, n.Destination)
-		_, _ = w.WriteString(`"`)
+		if bytes.HasPrefix(n.Destination, []byte("data:")) {
+			err := dataURIWrite(w, n.Destination)
+			if err != nil {
+				return ast.WalkStop, fmt.Errorf("image: %w", err)
+			}
+		} else {
+			_, _ = w.WriteString(`"`)
+			strWrite(w, n.Destination)
+			_, _ = w.WriteString(`"`)
+		}
+
+		if alt := plainText(n, source); len(alt) > 0 {
+			_, _ = w.WriteString(", ")
+			_, _ = w.WriteString("alt: ")
+			_, _ = w.WriteString(`"`)
+			strWrite(w, alt)
+			_, _ = w.WriteString(`"`)
+		}
+
+		for _, name := range []string{"width", "height"} {
+			if v, ok := attributeString(n, name); ok {
+				length, err := typstLength(v)
+				if err != nil {
+					return ast.WalkStop, fmt.Errorf("image %s: %w", name, err)
+				}
+				_, _ = w.WriteString(", ")
+				_, _ = w.WriteString(name)
+				_, _ = w.WriteString(": ")
+				_, _ = w.WriteString(length)
+			}
+		}
+
+		// AttributeASTTransformer has checked the fit.
+		if v, ok := attributeString(n, "fit"); ok {
+			_, _ = w.WriteString(", ")
+			_, _ = w.WriteString("fit: ")
+			_, _ = w.WriteString(`"`)
+			_, _ = w.WriteString(v)
+			_, _ = w.WriteString(`"`)
+		}
+
+		if inline && !hasWidth && !hasHeight {
+			_, _ = w.WriteString(", ")
+			_, _ = w.WriteString("height: ")
+			_, _ = w.WriteString("1em")
+		}
 
 		_, _ = w.WriteString(")")
+		if inline {
+			_, _ = w.WriteString(")")
+		}
 		_, _ = w.WriteString(";")
+
+		if subfigure {
+			_, _ = w.WriteString("]")
+			_, _ = w.WriteString(",\n")
+
+			_, _ = w.WriteString(")")
+			_, _ = w.WriteString(";")
+
+			if id, ok := attributeString(n, "id"); ok {
+				_, _ = w.WriteString("\n")
+				_, _ = w.WriteString("#")
+				_, _ = w.WriteString("label")
+				_, _ = w.WriteString("(")
+				_, _ = w.WriteString(`"`)
+				strWrite(w, []byte(id))
+				_, _ = w.WriteString(`"`)
+				_, _ = w.WriteString(")")
+				_, _ = w.WriteString(";")
+			}
+		}
+		if cell {
+			_, _ = w.WriteString("]")
+			_, _ = w.WriteString(",\n")
+		}
 		return ast.WalkSkipChildren, nil
 	} else {
 		return ast.WalkContinue, nil
@@ -280,7 +484,41 @@ func (r *Renderer) renderImage(w util.BufWriter, source []byte, node ast.Node, e
 }
 
 func (r *Renderer) renderLink(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
-	slog.Error("unimplemented renderLink")
+	if entering {
+		n := node.(*ast.Link)
+		_, _ = w.WriteString("#")
+		_, _ = w.WriteString("link")
+		_, _ = w.WriteString("(")
+		_, _ = w.WriteString(`"`)
+		strWrite(w, n.Destination)
+		_, _ = w.WriteString(`"`)
+		_, _ = w.WriteString(")")
+		_, _ = w.WriteString("[")
+	} else {
+		_, _ = w.WriteString("]")
+		_, _ = w.WriteString(";")
+	}
+	return ast.WalkContinue, nil
+}
+
+func (r *Renderer) renderCrossReference(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		n := node.(*CrossReference)
+		_, _ = w.WriteString("#")
+		_, _ = w.WriteString("link")
+		_, _ = w.WriteString("(")
+		_, _ = w.WriteString("label")
+		_, _ = w.WriteString("(")
+		_, _ = w.WriteString(`"`)
+		strWrite(w, []byte(n.Label))
+		_, _ = w.WriteString(`"`)
+		_, _ = w.WriteString(")")
+		_, _ = w.WriteString(")")
+		_, _ = w.WriteString("[")
+	} else {
+		_, _ = w.WriteString("]")
+		_, _ = w.WriteString(";")
+	}
 	return ast.WalkContinue, nil
 }
 
@@ -328,16 +566,17 @@ func (r *TableRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
 func (r *TableRenderer) renderTable(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
 	if entering {
 		n := node.(*extensionast.Table)
-		_, _ = w.WriteString("#")
-		_, _ = w.WriteString("figure")
-		_, _ = w.WriteString("(\n")
+		figureStartWrite(w, n)
 
-		// TODO: Get caption from attributes.
-		_, _ = w.WriteString("caption: ")
-		_, _ = w.WriteString(`"`)
-		strWrite(w, []byte("Lorem ipsum."))
-		_, _ = w.WriteString(`"`)
-		_, _ = w.WriteString(",\n")
+		if hasClass(n, "fit") {
+			// Figure can't detect the kind through papermark-fit.
+			_, _ = w.WriteString("kind: ")
+			_, _ = w.WriteString("table")
+			_, _ = w.WriteString(",\n")
+
+			_, _ = w.WriteString("papermark-fit")
+			_, _ = w.WriteString("(\n")
+		}
 
 		_, _ = w.WriteString("table")
 		_, _ = w.WriteString("(\n")
@@ -376,20 +615,12 @@ func (r *TableRenderer) renderTable(w util.BufWriter, source []byte, node ast.No
 		_, _ = w.WriteString(")")
 		_, _ = w.WriteString(",\n")
 
-		_, _ = w.WriteString(")")
-		_, _ = w.WriteString(";\n")
-
-		_, _ = w.WriteString("#")
-		_, _ = w.WriteString("label")
-		_, _ = w.WriteString("(")
-
-		// TODO: Get label from attributes.
-		_, _ = w.WriteString(`"`)
-		strWrite(w, []byte("lorem"))
-		_, _ = w.WriteString(`"`)
+		if hasClass(node, "fit") {
+			_, _ = w.WriteString(")")
+			_, _ = w.WriteString(",\n")
+		}
 
-		_, _ = w.WriteString(")")
-		_, _ = w.WriteString(";\n")
+		figureEndWrite(w, node)
 		if node.NextSibling() != nil {
 			_, _ = w.WriteRune('\n')
 		}
@@ -470,37 +701,487 @@ func (r *ImageBlockRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegister
 }
 
 func (r *ImageBlockRenderer) renderImageBlock(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	// An image block with the nofigure class is shown like a figure
+	// but gets neither a number nor a caption.
 	if entering {
-		_, _ = w.WriteString("#")
-		_, _ = w.WriteString("figure")
-		_, _ = w.WriteString("(\n")
-
-		// TODO: Get caption from attributes.
-		_, _ = w.WriteString("caption: ")
-		_, _ = w.WriteString(`"`)
-		strWrite(w, []byte("Lorem ipsum."))
-		_, _ = w.WriteString(`"`)
-		_, _ = w.WriteString(",\n")
+		if hasClass(n, "nofigure") {
+			landscapeStartWrite(w, n)
+			_, _ = w.WriteString("#")
+			_, _ = w.WriteString("align")
+			_, _ = w.WriteString("(")
+			_, _ = w.WriteString("center")
+			_, _ = w.WriteString(")")
+		} else {
+			figureStartWrite(w, n)
+			if n.ChildCount() > 1 {
+				_, _ = w.WriteString("kind: ")
+				_, _ = w.WriteString("image")
+				_, _ = w.WriteString(",\n")
+			}
+		}
 
+		// Align takes its body as a content block, so a fitted body is
+		// wrapped in one.
+		if hasClass(n, "fit") {
+			if hasClass(n, "nofigure") {
+				_, _ = w.WriteString("[#")
+			}
+			_, _ = w.WriteString("papermark-fit")
+		}
 		_, _ = w.WriteString("[")
+
+		if n.ChildCount() > 1 {
+			_, _ = w.WriteString("#")
+			_, _ = w.WriteString("grid")
+			_, _ = w.WriteString("(\n")
+
+			_, _ = w.WriteString("columns: ")
+			_, _ = w.WriteString(strconv.Itoa(n.ChildCount()))
+			_, _ = w.WriteString(",\n")
+
+			_, _ = w.WriteString("gutter: ")
+			_, _ = w.WriteString("1em")
+			_, _ = w.WriteString(",\n")
+		}
 	} else {
+		if n.ChildCount() > 1 {
+			_, _ = w.WriteString(")")
+			_, _ = w.WriteString(";")
+		}
 		_, _ = w.WriteString("]")
+		if hasClass(n, "nofigure") {
+			if hasClass(n, "fit") {
+				_, _ = w.WriteString(";]")
+			}
+			_, _ = w.WriteString(";\n")
+			landscapeEndWrite(w, n)
+		} else {
+			_, _ = w.WriteString(",\n")
+			figureEndWrite(w, n)
+		}
+		if n.NextSibling() != nil {
+			_, _ = w.WriteString("\n")
+		}
+	}
+	return ast.WalkContinue, nil
+}
+
+// listingWrite writes code in language lang as a listing of block n,
+// wrapped in a figure if n has a caption or an id to refer to. The
+// numbered class and the start attribute number the lines, the highlight
+// attribute highlights ranges of them, and callout markers such as
+// // <1> are replaced with numbered marks. These are drawn by a show
+// rule on raw.line written around the raw element.
+func listingWrite(w util.BufWriter, n ast.Node, lang []byte, code []byte) error {
+	code, callouts := cutCallouts(code)
+	count := len(splitLines(code))
+
+	numbered := hasClass(n, "numbered")
+	start := 1
+	if v, ok := attributeString(n, "start"); ok {
+		var err error
+		start, err = strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid listing start %q", v)
+		}
+		numbered = true
+	}
+	var highlighted [][2]int
+	if v, ok := attributeString(n, "highlight"); ok {
+		var err error
+		highlighted, err = parseLineRanges(v, start, start+count-1)
+		if err != nil {
+			return fmt.Errorf("listing highlight: %w", err)
+		}
+	}
+	lineRule := numbered || len(highlighted) != 0 || len(callouts) != 0
+
+	_, hasCaption := attributeString(n, "caption")
+	_, hasID := attributeString(n, "id")
+	figure := hasCaption || hasID
+	if figure {
+		figureStartWrite(w, n)
+
+		_, _ = w.WriteString("kind: ")
+		_, _ = w.WriteString("raw")
 		_, _ = w.WriteString(",\n")
+	} else {
+		landscapeStartWrite(w, n)
+		_, _ = w.WriteString("#")
+	}
 
-		_, _ = w.WriteString(")")
+	if lineRule {
+		_, _ = w.WriteString("{\n")
+		_, _ = w.WriteString("show raw.line: it => papermark-listing-line(it")
+		if numbered {
+			_, _ = w.WriteString(", numbered: true")
+		}
+		if start != 1 {
+			_, _ = w.WriteString(", start: ")
+			_, _ = w.WriteString(strconv.Itoa(start))
+		}
+		if len(highlighted) != 0 {
+			_, _ = w.WriteString(", highlighted: (")
+			for _, r := range highlighted {
+				for l := r[0]; l <= r[1]; l++ {
+					_, _ = w.WriteString(strconv.Itoa(l))
+					_, _ = w.WriteString(",")
+				}
+			}
+			_, _ = w.WriteString(")")
+		}
+		if len(callouts) != 0 {
+			_, _ = w.WriteString(", callouts: (")
+			for _, c := range callouts {
+				_, _ = fmt.Fprintf(w, "(%d, %d),", c.Line, c.Number)
+			}
+			_, _ = w.WriteString(")")
+		}
+		_, _ = w.WriteString(")\n")
+	}
+
+	_, _ = w.WriteString("raw")
+	_, _ = w.WriteString("(")
+
+	_, _ = w.WriteString("block: ")
+	_, _ = w.WriteString("true")
+	_, _ = w.WriteString(", ")
+
+	if len(lang) != 0 {
+		_, _ = w.WriteString("lang: ")
+		_, _ = w.WriteString(`"`)
+		strWrite(w, lang)
+		_, _ = w.WriteString(`"`)
+		_, _ = w.WriteString(", ")
+	}
+
+	_, _ = w.WriteString(`"`)
+	strWrite(w, code)
+	_, _ = w.WriteString(`"`)
+
+	_, _ = w.WriteString(")")
+	if lineRule {
+		_, _ = w.WriteString("\n}")
+	}
+
+	if figure {
+		_, _ = w.WriteString(",\n")
+		figureEndWrite(w, n)
+	} else {
 		_, _ = w.WriteString(";\n")
+		landscapeEndWrite(w, n)
+	}
+	return nil
+}
 
+// isCalloutList reports whether list n explains the callouts of the
+// listing right before it.
+func isCalloutList(n *ast.List, source []byte) bool {
+	if !n.IsOrdered() || n.PreviousSibling() == nil {
+		return false
+	}
+	_, code, ok := listingCode(n.PreviousSibling(), source)
+	if !ok {
+		return false
+	}
+	_, callouts := cutCallouts(code)
+	return len(callouts) != 0
+}
+
+// OutlineRenderer renders tables of contents and lists of figures and
+// tables, titled after the document language by the template.
+type OutlineRenderer struct{}
+
+func NewOutlineRenderer() *OutlineRenderer {
+	return &OutlineRenderer{}
+}
+
+func (r *OutlineRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindOutline, r.renderOutline)
+}
+
+func (r *OutlineRenderer) renderOutline(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		n := node.(*Outline)
 		_, _ = w.WriteString("#")
-		_, _ = w.WriteString("label")
+		_, _ = w.WriteString("outline")
 		_, _ = w.WriteString("(")
 
-		// TODO: Get label from attributes.
+		_, _ = w.WriteString("title: ")
+		_, _ = w.WriteString("papermark-outline-title")
+		_, _ = w.WriteString("(")
 		_, _ = w.WriteString(`"`)
-		strWrite(w, []byte("lorem"))
+		_, _ = w.WriteString(n.OutlineKind)
 		_, _ = w.WriteString(`"`)
+		_, _ = w.WriteString(")")
+
+		switch n.OutlineKind {
+		case "lof":
+			_, _ = w.WriteString(", ")
+			_, _ = w.WriteString("target: figure.where(kind: image)")
+		case "lot":
+			_, _ = w.WriteString(", ")
+			_, _ = w.WriteString("target: figure.where(kind: table)")
+		}
+
+		if n.Depth != 0 {
+			_, _ = w.WriteString(", ")
+			_, _ = w.WriteString("depth: ")
+			_, _ = w.WriteString(strconv.Itoa(n.Depth))
+		}
+
+		_, _ = w.WriteString(")")
+		_, _ = w.WriteString(";\n")
+		if node.NextSibling() != nil {
+			_, _ = w.WriteString("\n")
+		}
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+// CitationRenderer renders citations and bibliographies, which are titled
+// and styled after the document language by the template unless they
+// have a style.
+type CitationRenderer struct{}
+
+func NewCitationRenderer() *CitationRenderer {
+	return &CitationRenderer{}
+}
+
+func (r *CitationRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindCitation, r.renderCitation)
+	reg.Register(KindBibliography, r.renderBibliography)
+}
+
+func (r *CitationRenderer) renderCitation(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		n := node.(*Citation)
+		for _, item := range n.Items {
+			_, _ = w.WriteString("#")
+			_, _ = w.WriteString("cite")
+			_, _ = w.WriteString("(")
+			_, _ = w.WriteString("label")
+			_, _ = w.WriteString("(")
+			_, _ = w.WriteString(`"`)
+			strWrite(w, []byte(item.Key))
+			_, _ = w.WriteString(`"`)
+			_, _ = w.WriteString(")")
+			if n.Prose {
+				_, _ = w.WriteString(", ")
+				_, _ = w.WriteString(`form: "prose"`)
+			}
+			if item.Supplement != "" {
+				_, _ = w.WriteString(", ")
+				_, _ = w.WriteString("supplement: ")
+				_, _ = w.WriteString(`"`)
+				strWrite(w, []byte(item.Supplement))
+				_, _ = w.WriteString(`"`)
+			}
+			_, _ = w.WriteString(")")
+			_, _ = w.WriteString(";")
+		}
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+func (r *CitationRenderer) renderBibliography(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		n := node.(*Bibliography)
+		_, _ = w.WriteString("#")
+		_, _ = w.WriteString("papermark-bibliography")
+		_, _ = w.WriteString("(")
+		_, _ = w.WriteString("(")
+		for _, file := range n.Files {
+			_, _ = w.WriteString(`"`)
+			strWrite(w, []byte(file))
+			_, _ = w.WriteString(`"`)
+			_, _ = w.WriteString(",")
+		}
+		_, _ = w.WriteString(")")
+		if n.Style != "" {
+			_, _ = w.WriteString(", ")
+			_, _ = w.WriteString("style: ")
+			_, _ = w.WriteString(`"`)
+			strWrite(w, []byte(n.Style))
+			_, _ = w.WriteString(`"`)
+		}
+		_, _ = w.WriteString(")")
+		_, _ = w.WriteString(";\n")
+		if node.NextSibling() != nil {
+			_, _ = w.WriteString("\n")
+		}
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+type RawStyleRenderer struct{}
+
+func NewRawStyleRenderer() *RawStyleRenderer {
+	return &RawStyleRenderer{}
+}
+
+func (r *RawStyleRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindRawStyle, r.renderRawStyle)
+}
+
+func (r *RawStyleRenderer) renderRawStyle(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		n := node.(*RawStyle)
+		_, _ = w.WriteString("#")
+		_, _ = w.WriteString("set")
+		_, _ = w.WriteString(" ")
+		_, _ = w.WriteString("raw")
+		_, _ = w.WriteString("(")
+
+		if n.Theme != "" {
+			_, _ = w.WriteString("theme: ")
+			_, _ = w.WriteString(`"`)
+			strWrite(w, []byte(n.Theme))
+			_, _ = w.WriteString(`"`)
+			if len(n.Syntaxes) != 0 {
+				_, _ = w.WriteString(", ")
+			}
+		}
+
+		if len(n.Syntaxes) != 0 {
+			_, _ = w.WriteString("syntaxes: ")
+			_, _ = w.WriteString("(")
+			for _, syntax := range n.Syntaxes {
+				_, _ = w.WriteString(`"`)
+				strWrite(w, []byte(syntax))
+				_, _ = w.WriteString(`"`)
+				_, _ = w.WriteString(",")
+			}
+			_, _ = w.WriteString(")")
+		}
+
+		_, _ = w.WriteString(")")
+		_, _ = w.WriteString(";\n")
+		if node.NextSibling() != nil {
+			_, _ = w.WriteString("\n")
+		}
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+// BookRenderer renders the parts and page breaks of books and the start
+// of appendices.
+type BookRenderer struct{}
+
+func NewBookRenderer() *BookRenderer {
+	return &BookRenderer{}
+}
+
+func (r *BookRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindPart, r.renderPart)
+	reg.Register(KindPageBreak, r.renderPageBreak)
+}
+
+func (r *BookRenderer) renderPart(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		n := node.(*Part)
+		if n.Title != "" {
+			_, _ = w.WriteString("#")
+			_, _ = w.WriteString("papermark-part")
+			_, _ = w.WriteString("(")
+			_, _ = w.WriteString(`"`)
+			strWrite(w, []byte(n.Title))
+			_, _ = w.WriteString(`"`)
+			_, _ = w.WriteString(")")
+			_, _ = w.WriteString(";\n")
+		}
+		if n.Appendices {
+			_, _ = w.WriteString("#")
+			_, _ = w.WriteString("show")
+			_, _ = w.WriteString(": ")
+			_, _ = w.WriteString("papermark-appendices")
+			_, _ = w.WriteString("\n")
+		}
+		if node.NextSibling() != nil {
+			_, _ = w.WriteString("\n")
+		}
+	}
+	return ast.WalkSkipChildren, nil
+}
 
+func (r *BookRenderer) renderPageBreak(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		_, _ = w.WriteString("#")
+		_, _ = w.WriteString("pagebreak")
+		_, _ = w.WriteString("(")
+		_, _ = w.WriteString("weak: true")
 		_, _ = w.WriteString(")")
 		_, _ = w.WriteString(";\n")
+		if node.NextSibling() != nil {
+			_, _ = w.WriteString("\n")
+		}
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+// TransclusionRenderer renders the blocks of included files with
+// Renderer, passing them the source of their file.
+type TransclusionRenderer struct {
+	Renderer renderer.Renderer
+}
+
+func NewTransclusionRenderer(r renderer.Renderer) *TransclusionRenderer {
+	return &TransclusionRenderer{Renderer: r}
+}
+
+func (r *TransclusionRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindTransclusion, r.renderTransclusion)
+}
+
+func (r *TransclusionRenderer) renderTransclusion(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		n := node.(*Transclusion)
+		for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+			err := r.Renderer.Render(w, n.Source, c)
+			if err != nil {
+				return ast.WalkStop, err
+			}
+		}
+		if n.HasChildren() && n.NextSibling() != nil {
+			_, _ = w.WriteString("\n")
+		}
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+type ChartBlockRenderer struct{}
+
+func NewChartBlockRenderer() *ChartBlockRenderer {
+	return &ChartBlockRenderer{}
+}
+
+func (r *ChartBlockRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindChartBlock, r.renderChartBlock)
+}
+
+func (r *ChartBlockRenderer) renderChartBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		n := node.(*ChartBlock)
+		figureStartWrite(w, n)
+
+		_, _ = w.WriteString("kind: ")
+		_, _ = w.WriteString("image")
+		_, _ = w.WriteString(",\n")
+
+		if hasClass(n, "fit") {
+			_, _ = w.WriteString("papermark-fit")
+			_, _ = w.WriteString("(")
+		}
+		err := n.Chart.write(w)
+		if err != nil {
+			return ast.WalkStop, err
+		}
+		if hasClass(n, "fit") {
+			_, _ = w.WriteString(")")
+		}
+		_, _ = w.WriteString(",\n")
+
+		figureEndWrite(w, n)
 		if n.NextSibling() != nil {
 			_, _ = w.WriteString("\n")
 		}
@@ -508,6 +1189,149 @@ func (r *ImageBlockRenderer) renderImageBlock(w util.BufWriter, source []byte, n
 	return ast.WalkContinue, nil
 }
 
+// landscapeStartWrite starts a flipped page if n has the landscape class.
+func landscapeStartWrite(w util.BufWriter, n ast.Node) {
+	if hasClass(n, "landscape") {
+		_, _ = w.WriteString("#")
+		_, _ = w.WriteString("page")
+		_, _ = w.WriteString("(")
+		_, _ = w.WriteString("flipped: ")
+		_, _ = w.WriteString("true")
+		_, _ = w.WriteString(")")
+		_, _ = w.WriteString("[\n")
+	}
+}
+
+// landscapeEndWrite ends a page started with landscapeStartWrite.
+func landscapeEndWrite(w util.BufWriter, n ast.Node) {
+	if hasClass(n, "landscape") {
+		_, _ = w.WriteString("]")
+		_, _ = w.WriteString(";\n")
+	}
+}
+
+// figureStartWrite writes the start of a figure for a table or an image
+// block n, up to and including its caption argument. A figure with the
+// landscape class is put on its own flipped page.
+func figureStartWrite(w util.BufWriter, n ast.Node) {
+	landscapeStartWrite(w, n)
+
+	_, _ = w.WriteString("#")
+	_, _ = w.WriteString("figure")
+	_, _ = w.WriteString("(\n")
+
+	if caption, ok := attributeString(n, "caption"); ok {
+		_, _ = w.WriteString("caption: ")
+		_, _ = w.WriteString(`"`)
+		strWrite(w, []byte(caption))
+		_, _ = w.WriteString(`"`)
+		_, _ = w.WriteString(",\n")
+	}
+}
+
+// figureEndWrite writes the end of a figure started with figureStartWrite,
+// including its label.
+func figureEndWrite(w util.BufWriter, n ast.Node) {
+	_, _ = w.WriteString(")")
+	_, _ = w.WriteString(";\n")
+
+	if id, ok := attributeString(n, "id"); ok {
+		_, _ = w.WriteString("#")
+		_, _ = w.WriteString("label")
+		_, _ = w.WriteString("(")
+		_, _ = w.WriteString(`"`)
+		strWrite(w, []byte(id))
+		_, _ = w.WriteString(`"`)
+		_, _ = w.WriteString(")")
+		_, _ = w.WriteString(";\n")
+	}
+
+	landscapeEndWrite(w, n)
+}
+
+// dataURIWrite writes the image in a data URI as bytes followed by its
+// format. SVG is written as a string, anything else as a byte array.
+func dataURIWrite(w util.BufWriter, uri []byte) error {
+	mediaType, data, err := decodeDataURI(uri)
+	if err != nil {
+		return err
+	}
+	format, ok := imageFormats[mediaType]
+	if !ok {
+		return fmt.Errorf("unsupported data URI media type %s", mediaType)
+	}
+
+	_, _ = w.WriteString("bytes")
+	_, _ = w.WriteString("(")
+	if format == "svg" {
+		_, _ = w.WriteString(`"`)
+		strWrite(w, data)
+		_, _ = w.WriteString(`"`)
+	} else {
+		_, _ = w.WriteString("(")
+		for i, b := range data {
+			if i != 0 {
+				_, _ = w.WriteString(", ")
+			}
+			_, _ = w.WriteString(strconv.Itoa(int(b)))
+		}
+		if len(data) == 1 {
+			_, _ = w.WriteString(",")
+		}
+		_, _ = w.WriteString(")")
+	}
+	_, _ = w.WriteString(")")
+
+	_, _ = w.WriteString(", ")
+	_, _ = w.WriteString("format: ")
+	_, _ = w.WriteString(`"`)
+	_, _ = w.WriteString(format)
+	_, _ = w.WriteString(`"`)
+	return nil
+}
+
+// plainText returns the text of the inline descendants of n without markup.
+func plainText(n ast.Node, source []byte) []byte {
+	var buf bytes.Buffer
+	_ = ast.Walk(n, func(c ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering {
+			switch c := c.(type) {
+			case *ast.Text:
+				buf.Write(c.Value(source))
+				if c.SoftLineBreak() || c.HardLineBreak() {
+					buf.WriteByte(' ')
+				}
+			case *ast.String:
+				buf.Write(c.Value)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+	return bytes.TrimSpace(buf.Bytes())
+}
+
+var lengthPattern = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?|\.[0-9]+)(pt|mm|cm|in|em|%|px)?$`)
+
+// typstLength converts a length such as 300, 300px, 8cm or 50% to Typst.
+// Unitless lengths are pixels, which Typst lacks, so they are converted
+// to points at 96 pixels per inch.
+func typstLength(s string) (string, error) {
+	m := lengthPattern.FindStringSubmatch(s)
+	if m == nil {
+		return "", fmt.Errorf("invalid length %q", s)
+	}
+	switch m[2] {
+	case "", "px":
+		f, err := strconv.ParseFloat(m[1], 64)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatFloat(f*0.75, 'f', -1, 64) + "pt", nil
+	default:
+		return m[1] + m[2], nil
+	}
+}
+
 func unsafeWrite(w util.BufWriter, p []byte) {
 	_, _ = w.Write(p)
 }
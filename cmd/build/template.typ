@@ -1,9 +1,22 @@
 // model / bibliography
 
+// Bibliographies are titled after the document language. Russian ones are
+// given the GOST R 7.0.5-2008 style bundled with papermark, others default
+// to ieee.
+#let papermark-bibliography-titles = (en: [References], ru: [Список использованных источников])
+#let papermark-bibliography(sources, style: "ieee") = context bibliography(
+    sources,
+    title: papermark-bibliography-titles.at(text.lang, default: auto),
+    style: style,
+)
+
 // model / cite
 
 // model / document
 
+// The title of the document stands above its body.
+#let papermark-title(title) = align(center, block(below: 20pt, text(size: 16pt, weight: "bold", upper(title))))
+
 // model / emph
 
 // model / enum
@@ -15,6 +28,19 @@
 
 // model / figure
 
+// Sub-figures are numbered (a), (b), (c) within each figure.
+#show figure.where(kind: image): it => {
+    counter(figure.where(kind: "subfigure")).update(0)
+    it
+}
+#show figure.where(kind: "subfigure"): set figure.caption(separator: " ")
+
+// Listings are called after the document language and may break across
+// pages.
+#let papermark-listing-supplement = (en: [Listing], ru: [Листинг])
+#show figure.where(kind: raw): set figure(supplement: context papermark-listing-supplement.at(text.lang, default: [Listing]))
+#show figure.where(kind: raw): set block(breakable: true)
+
 // model / footnote
 
 // model / heading
@@ -37,6 +63,75 @@
 #show selector.or(..(3, 4, 5, 6).map(i => heading.where(level: i))): set text(size: 14pt)
 #show selector.or(..(3, 4, 5, 6).map(i => heading.where(level: i))): emph
 
+// Figures, tables, listings and equations can be numbered within chapters,
+// as in 2.3, which references show as well. Unnumbered chapters such as
+// the introduction don't step the heading counter, so their items are
+// numbered without a chapter prefix.
+#let papermark-chapter-numbered = state("papermark-chapter-numbered", false)
+#let papermark-chapter-item-numbering(n) = {
+    if papermark-chapter-numbered.get() {
+        numbering("1.1", counter(heading).get().first(), n)
+    } else {
+        numbering("1", n)
+    }
+}
+#let papermark-chapter-numbering(body) = {
+    show heading.where(level: 1): it => {
+        for kind in (image, table, raw) {
+            counter(figure.where(kind: kind)).update(0)
+        }
+        counter(math.equation).update(0)
+        papermark-chapter-numbered.update(it.numbering != none)
+        it
+    }
+    set figure(numbering: papermark-chapter-item-numbering)
+    set math.equation(numbering: n => "(" + papermark-chapter-item-numbering(n) + ")")
+    body
+}
+
+// Appendices are numbered with letters, skipping the ones GOST 2.105
+// leaves out, and start on a new page titled ПРИЛОЖЕНИЕ А and so on.
+// Figures, tables, listings and equations are numbered within them, as in
+// А.1.
+#let papermark-appendix-supplements = (en: [Appendix], ru: [Приложение])
+#let papermark-appendix-letters = (en: "ABCDEFGHJKLMNPQRSTUVWXYZ", ru: "АБВГДЕЖИКЛМНПРСТУФХЦШЩЭЮЯ")
+#let papermark-appendix-numbering(..nums) = {
+    let nums = nums.pos()
+    let letters = papermark-appendix-letters.at(text.lang, default: papermark-appendix-letters.en).clusters()
+    (letters.at(nums.first() - 1), ..nums.slice(1).map(str)).join(".")
+}
+#let papermark-appendix-item-numbering(n) = {
+    papermark-appendix-numbering(counter(heading).get().first(), n)
+}
+#let papermark-appendices(body) = {
+    pagebreak(weak: true)
+    counter(heading).update(0)
+    set heading(
+        numbering: papermark-appendix-numbering,
+        supplement: context papermark-appendix-supplements.at(text.lang, default: [Appendix]),
+    )
+    show heading.where(level: 1): it => {
+        pagebreak(weak: true)
+        if it.numbering == none {
+            return it
+        }
+        for kind in (image, table, raw) {
+            counter(figure.where(kind: kind)).update(0)
+        }
+        counter(math.equation).update(0)
+        block(width: 100%, {
+            upper(it.supplement)
+            [ ]
+            counter(heading).display(it.numbering)
+            linebreak()
+            it.body
+        })
+    }
+    set figure(numbering: papermark-appendix-item-numbering)
+    set math.equation(numbering: n => "(" + papermark-appendix-item-numbering(n) + ")")
+    body
+}
+
 // model / link
 
 // model / list
@@ -50,6 +145,17 @@
 
 // model / outline
 
+// Outlines are titled after the document language.
+#let papermark-outline-titles = (
+    toc: (en: [Contents], ru: [Содержание]),
+    lof: (en: [List of Figures], ru: [Список иллюстраций]),
+    lot: (en: [List of Tables], ru: [Список таблиц]),
+)
+#let papermark-outline-title(kind) = context {
+    let titles = papermark-outline-titles.at(kind)
+    titles.at(text.lang, default: titles.en)
+}
+
 // model / par
 
 #set par(
@@ -85,6 +191,29 @@
 
 #show raw: set text(font: "Courier New")
 
+// Listing lines are numbered, highlighted and marked with callouts by a
+// show rule on raw.line that calls papermark-listing-line. Callouts are
+// (line, number) pairs.
+#let papermark-callout(n) = text(size: 0.9em, numbering("①", n))
+#let papermark-listing-line(it, numbered: false, start: 1, highlighted: (), callouts: ()) = {
+    let number = start + it.number - 1
+    let body = it.body
+    for (line, n) in callouts {
+        if line == it.number {
+            body = body + h(0.5em) + papermark-callout(n)
+        }
+    }
+    if numbered {
+        // Courier New digits are 0.6em wide.
+        let width = str(start + it.count - 1).len() * 0.6em
+        body = box(width: width, align(right, text(fill: luma(50%), str(number)))) + h(1em) + body
+    }
+    if number in highlighted {
+        body = box(width: 100%, fill: luma(90%), outset: (y: 0.25em), body)
+    }
+    body
+}
+
 // text / smallcaps
 
 // text / smartquote
@@ -159,6 +288,15 @@
 
 // layout / pagebreak
 
+// Parts of books get a page of their own with the title in the middle.
+#let papermark-part(title) = {
+    pagebreak(weak: true)
+    v(1fr)
+    align(center, text(size: 16pt, weight: "bold", upper(title)))
+    v(1fr)
+    pagebreak()
+}
+
 // layout / place
 
 // layout / ratio
@@ -171,6 +309,15 @@
 
 // layout / scale
 
+#let papermark-fit(body) = layout(size => {
+    let width = measure(body).width
+    if width > size.width {
+        scale(size.width / width * 100%, reflow: true, body)
+    } else {
+        body
+    }
+})
+
 // layout / skew
 
 // layout / stack
@@ -181,6 +328,12 @@
 
 // visualize / color
 
+// Charts are drawn in shades of gray to print well in black and white.
+#let papermark-chart-palette = (luma(20%), luma(60%), luma(40%), luma(80%))
+#let papermark-chart-stroke = 0.75pt
+#let papermark-chart-grid = 0.25pt + luma(85%)
+#let papermark-chart-text-size = 10pt
+
 // visualize / curve
 
 // visualize / ellipse
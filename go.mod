@@ -2,4 +2,8 @@ module github.com/k11v/papermark
 
 go 1.24.1
 
-require github.com/yuin/goldmark v1.7.8
+require (
+	github.com/yuin/goldmark v1.7.8
+	golang.org/x/image v0.25.0
+	gopkg.in/yaml.v3 v3.0.1
+)